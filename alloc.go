@@ -0,0 +1,54 @@
+package uot
+
+import (
+	"sync"
+)
+
+// allocBuf and freeBuf acquire and release internal buffers, see SetBufferAllocator.
+var (
+	allocBuf = defaultAlloc
+	freeBuf  = defaultFree
+)
+
+// smallBufSize is size of pooled buffers for small packets, larger than common path MTU.
+const smallBufSize = 2048
+
+var (
+	smallBufPool = sync.Pool{New: func() interface{} { return new([smallBufSize]byte) }}
+	largeBufPool = sync.Pool{New: func() interface{} { return new([MaxPacketSize]byte) }}
+)
+
+// defaultAlloc get a buffer from pool, or make one if n is over MaxPacketSize.
+func defaultAlloc(n int) []byte {
+	switch {
+	case n <= smallBufSize:
+		return smallBufPool.Get().(*[smallBufSize]byte)[:n]
+	case n <= MaxPacketSize:
+		return largeBufPool.Get().(*[MaxPacketSize]byte)[:n]
+	}
+	return make([]byte, n)
+}
+
+// defaultFree put a buffer from defaultAlloc back to pool.
+func defaultFree(b []byte) {
+	switch cap(b) {
+	case smallBufSize:
+		smallBufPool.Put((*[smallBufSize]byte)(b[:smallBufSize]))
+	case MaxPacketSize:
+		largeBufPool.Put((*[MaxPacketSize]byte)(b[:MaxPacketSize]))
+	}
+}
+
+// SetBufferAllocator set the allocator of all internal buffers, e.g. read buffers and packet buffers.
+// alloc must return a buffer of length n. free is called when a buffer from alloc is no longer used.
+// Buffers returned to caller, e.g. socks addrs, are not from alloc.
+// Default is two sync.Pool of small and MaxPacketSize buffers, nil alloc or free restores the default.
+//
+// It's not safe for concurrent use, call it before using the package.
+// alloc and free must be safe for concurrent use.
+func SetBufferAllocator(alloc func(n int) []byte, free func([]byte)) {
+	if alloc == nil || free == nil {
+		alloc, free = defaultAlloc, defaultFree
+	}
+	allocBuf, freeBuf = alloc, free
+}
@@ -0,0 +1,56 @@
+package uot
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetBufferAllocator(t *testing.T) {
+	var allocs, frees atomic.Int32
+	SetBufferAllocator(func(n int) []byte {
+		allocs.Add(1)
+		return make([]byte, n, MaxPacketSize)
+	}, func([]byte) {
+		frees.Add(1)
+	})
+	defer SetBufferAllocator(nil, nil)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c, peer := newConn(a, ConnOptions{}, true), newConn(b, ConnOptions{}, false)
+	done := make(chan struct{})
+	go func() {
+		c.Write([]byte("hello"))
+		close(done)
+	}()
+	buf := make([]byte, 16)
+	if _, err := peer.ReadDeadline(buf, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	// Write packet buffer and ReadDeadline pending payload buffer.
+	if n := allocs.Load(); n < 2 {
+		t.Fatalf("%d allocs, want at least 2", n)
+	}
+	if allocs.Load() != frees.Load() {
+		t.Fatalf("%d allocs, %d frees, want all buffers freed", allocs.Load(), frees.Load())
+	}
+
+	SetBufferAllocator(nil, nil)
+	before := allocs.Load()
+	done = make(chan struct{})
+	go func() {
+		c.Write([]byte("hello"))
+		close(done)
+	}()
+	if _, err := peer.ReadDeadline(buf, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if allocs.Load() != before {
+		t.Fatal("allocator still called after restoring the default")
+	}
+}
@@ -0,0 +1,75 @@
+package uot
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// capture direction markers.
+const (
+	CaptureRead  = '<'
+	CaptureWrite = '>'
+)
+
+// captureConn copy all bytes read and written to w.
+type captureConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	w      io.Writer
+	closed atomic.Bool
+}
+
+var _ net.Conn = (*captureConn)(nil)
+
+/*
+Capture record format of WithCapture:
+[direction][size][data]
+
+direction: 1-byte, CaptureRead or CaptureWrite.
+size: 4-byte, length of data.
+data: raw bytes read from or written to the conn.
+*/
+
+// WithCapture return a net.Conn that writes a copy of all bytes read and written to w.
+// Wrap the raw conn before passing to DefaultOutConn or DefaultInConn to capture framed traffic.
+// Capture write errors are ignored, so they never break the relay.
+func WithCapture(conn net.Conn, w io.Writer) net.Conn {
+	return &captureConn{Conn: conn, w: w}
+}
+
+func (c *captureConn) capture(direction byte, b []byte) {
+	n := len(b)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.w.Write([]byte{direction, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	c.w.Write(b)
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.capture(CaptureRead, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.capture(CaptureWrite, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
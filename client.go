@@ -24,6 +24,21 @@ type Client struct {
 	// if a large number of UDP packets arrived, there's no time to send it to remote over tcp.
 	// if buffer is full, new udp packet will be dropped.
 	BufSize int
+	// ReplySource reads source address in front of each reply payload, and passes it to PacketConn.WritePacket
+	// as target, so app sees the real source of each reply. Server.ReplySource must be the same.
+	ReplySource bool
+	// ReplySourceIDs reads source address of replies as ids assigned by server, it needs ReplySource.
+	// Server.ReplySourceIDs must be the same.
+	ReplySourceIDs bool
+	// CoalesceWindow batches packets of a flow arriving within the window after a packet into a single tcp write,
+	// default 0, no batching. It trades latency for fewer tcp segments under bursts of small packets.
+	// Each packet is still its own frame, server relays them as separate udp packets without any option.
+	// It takes effect if Dialer returns a Conn with Cork and Uncork, like a default Conn.
+	CoalesceWindow time.Duration
+	// UDPReadBuffer is receive buffer size in bytes of the udp socket Serve reads, default 0, system value.
+	// A larger buffer avoids kernel drops under bursts. It's applied if the PacketConn has SetReadBuffer,
+	// like a default PacketConn of *net.UDPConn.
+	UDPReadBuffer int
 	// Logf is log func, default nil, no log output.
 	Logf func(string, ...interface{})
 }
@@ -34,6 +49,15 @@ func (c *Client) logf(format string, v ...interface{}) {
 	}
 }
 
+// connLogf is logf prefixed with id of conn, see ConnOptions.ID.
+func (c *Client) connLogf(conn Conn, format string, v ...interface{}) {
+	if id := connID(conn); id != "" {
+		c.logf("[%s] "+format, append([]interface{}{id}, v...)...)
+		return
+	}
+	c.logf(format, v...)
+}
+
 func (c *Client) timeout() time.Duration {
 	if c.Timeout > 0 {
 		return c.Timeout
@@ -48,10 +72,24 @@ func (c *Client) bufSize() int {
 	return packetBufSize
 }
 
+// corker is implemented by Conn able to batch packets into a single underlying write.
+type corker interface {
+	Cork()
+	Uncork() error
+}
+
 // Serve read udp packet and send to server over tcp.
 // read response from server and send to address on the packet.
 func (c *Client) Serve(conn PacketConn, server string) {
-	buf := make([]byte, MaxPacketSize)
+	if c.UDPReadBuffer > 0 {
+		if rb, ok := conn.(interface{ SetReadBuffer(int) error }); !ok {
+			c.logf("udp conn does not support SetReadBuffer")
+		} else if err := rb.SetReadBuffer(c.UDPReadBuffer); err != nil {
+			c.logf("set read buffer error: %s", err)
+		}
+	}
+	buf := allocBuf(MaxPacketSize)
+	defer freeBuf(buf)
 	nat := nat{
 		m: make(map[string]chan []byte),
 	}
@@ -78,26 +116,27 @@ func (c *Client) Serve(conn PacketConn, server string) {
 					return
 				}
 				defer rc.Close()
-				c.logf("%s <---> %s <---> %s", key, server, target.String())
+				c.connLogf(rc, "%s <---> %s <---> %s", key, server, target.String())
 				// handshake, send target addr to remote.
 				_, err = rc.Handshake(target)
 				if err != nil {
-					c.logf("handshake error: %s", err)
+					c.connLogf(rc, "handshake error: %s", err)
 					return
 				}
 				err = c.relay(conn, rc, target, addr, pbuf)
 				if err != nil {
-					c.logf("relay error: %s", err)
+					c.connLogf(rc, "relay error: %s", err)
 				}
 				nat.Del(key)
 			}()
 		}
-		b := make([]byte, n)
+		b := allocBuf(n)
 		copy(b, buf)
 		select {
 		case pbuf <- b:
 		default:
 			c.logf("drop packet from %s", key)
+			freeBuf(b)
 		}
 	}
 }
@@ -108,6 +147,7 @@ func (c *Client) relay(conn PacketConn, rc Conn, target net.Addr, addr net.Addr,
 	// relay from udp to tcp
 	go func() {
 		defer rc.SetReadDeadline(time.Now()) // wake up anthoer goroutine
+		cc, _ := rc.(corker)
 		for {
 			t := time.NewTimer(c.timeout())
 			select {
@@ -116,11 +156,22 @@ func (c *Client) relay(conn PacketConn, rc Conn, target net.Addr, addr net.Addr,
 					done <- nil
 					return
 				}
-				_, err := rc.Write(buf)
+				var err error
+				more := true
+				if c.CoalesceWindow > 0 && cc != nil {
+					more, err = c.writeCoalesced(rc, cc, buf, pbuf)
+				} else {
+					_, err = rc.Write(buf)
+					freeBuf(buf)
+				}
 				if err != nil {
 					done <- err
 					return
 				}
+				if !more {
+					done <- nil
+					return
+				}
 			case <-t.C:
 				done <- nil
 				return
@@ -132,13 +183,22 @@ func (c *Client) relay(conn PacketConn, rc Conn, target net.Addr, addr net.Addr,
 	// relay from tcp to udp
 	var err error
 	var n int
-	buf := make([]byte, MaxPacketSize)
+	var srcs []net.Addr // reply sources by id, with ReplySourceIDs
+	buf := allocBuf(MaxPacketSize)
+	defer freeBuf(buf)
 	for {
 		n, err = rc.Read(buf)
 		if err != nil {
 			break
 		}
-		_, err = conn.WritePacket(buf[:n], target, addr)
+		p, src := buf[:n], target
+		if c.ReplySource {
+			p, src, srcs, err = c.splitReplySource(p, srcs)
+			if err != nil {
+				break
+			}
+		}
+		_, err = conn.WritePacket(p, src, addr)
 		if err != nil {
 			break
 		}
@@ -155,3 +215,62 @@ func (c *Client) relay(conn PacketConn, rc Conn, target net.Addr, addr net.Addr,
 	}
 	return nil
 }
+
+// splitReplySource split source address off reply p, and return payload and source.
+// With ReplySourceIDs, srcs is sources assigned ids so far, returned with the source p assigns appended.
+func (c *Client) splitReplySource(p []byte, srcs []net.Addr) ([]byte, net.Addr, []net.Addr, error) {
+	if !c.ReplySourceIDs {
+		a, m, err := SplitSocksAddr(p)
+		if err != nil {
+			return nil, nil, srcs, err
+		}
+		return p[m:], targetAddr(a), srcs, nil
+	}
+	if len(p) == 0 {
+		return nil, nil, srcs, ErrShortAddr
+	}
+	id := p[0]
+	if id < replySourceDefine {
+		if int(id) >= len(srcs) {
+			return nil, nil, srcs, errReplySourceID
+		}
+		return p[1:], srcs[id], srcs, nil
+	}
+	a, m, err := SplitSocksAddr(p[1:])
+	if err != nil {
+		return nil, nil, srcs, err
+	}
+	if id != replySourceInline {
+		// server assigns ids in order.
+		if int(id&^replySourceDefine) != len(srcs) {
+			return nil, nil, srcs, errReplySourceID
+		}
+		a = append(SocksAddr(nil), a...) // p is overwritten by next reply
+		srcs = append(srcs, targetAddr(a))
+	}
+	return p[1+m:], targetAddr(a), srcs, nil
+}
+
+// writeCoalesced write buf and packets arriving within CoalesceWindow after it in a single underlying write.
+// It returns false if the other relay goroutine asks to stop.
+func (c *Client) writeCoalesced(rc Conn, cc corker, buf []byte, pbuf chan []byte) (bool, error) {
+	cc.Cork()
+	t := time.NewTimer(c.CoalesceWindow)
+	defer t.Stop()
+	for {
+		_, err := rc.Write(buf)
+		freeBuf(buf)
+		if err != nil {
+			cc.Uncork()
+			return true, err
+		}
+		select {
+		case buf = <-pbuf:
+			if buf == nil {
+				return false, cc.Uncork()
+			}
+		case <-t.C:
+			return true, cc.Uncork()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package uot
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readBufferPacketConn is a PacketConn recording SetReadBuffer, whose reads fail as closed.
+type readBufferPacketConn struct {
+	PacketConn
+	readBuffer int
+}
+
+func (c *readBufferPacketConn) SetReadBuffer(bytes int) error {
+	c.readBuffer = bytes
+	return nil
+}
+
+func (c *readBufferPacketConn) ReadPacket(p []byte) (int, net.Addr, net.Addr, error) {
+	return 0, nil, nil, net.ErrClosed
+}
+
+func TestClientUDPReadBuffer(t *testing.T) {
+	conn := &readBufferPacketConn{}
+	c := Client{UDPReadBuffer: 1 << 20}
+	c.Serve(conn, "127.0.0.1:1")
+	if conn.readBuffer != 1<<20 {
+		t.Fatalf("read buffer is %d, want %d", conn.readBuffer, 1<<20)
+	}
+
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	rb, ok := DefaultPacketConn(uc).(interface{ SetReadBuffer(int) error })
+	if !ok {
+		t.Fatal("default PacketConn has no SetReadBuffer")
+	}
+	if err = rb.SetReadBuffer(1 << 20); err != nil {
+		t.Fatalf("SetReadBuffer error = %v", err)
+	}
+}
+
+// chanPacketConn is a PacketConn reading packets sent on a chan, whose reads fail as closed after the chan is closed.
+type chanPacketConn struct {
+	PacketConn
+	packets chan []byte
+	target  net.Addr
+}
+
+func (c *chanPacketConn) ReadPacket(p []byte) (int, net.Addr, net.Addr, error) {
+	b, ok := <-c.packets
+	if !ok {
+		return 0, nil, nil, net.ErrClosed
+	}
+	return copy(p, b), c.target, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, nil
+}
+
+func (c *chanPacketConn) WritePacket(p []byte, target net.Addr, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+// atomicWriteCountConn count writes to the underlying conn, safe to read while writing.
+type atomicWriteCountConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *atomicWriteCountConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+func TestClientCoalesceWindow(t *testing.T) {
+	up, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	var s Server
+	a, b := net.Pipe()
+	go s.Serve(DefaultInConn(b))
+	wc := &atomicWriteCountConn{Conn: a}
+	c := Client{
+		CoalesceWindow: 50 * time.Millisecond,
+		Dialer:         func(string) (Conn, error) { return DefaultOutConn(wc), nil },
+	}
+	conn := &chanPacketConn{
+		packets: make(chan []byte, 3),
+		target:  targetAddr(ParseSocksAddr(up.LocalAddr().String())),
+	}
+	want := []string{"one", "two", "three"}
+	for _, p := range want {
+		conn.packets <- []byte(p)
+	}
+	go c.Serve(conn, "uot")
+	defer close(conn.packets)
+
+	up.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	for _, p := range want {
+		n, _, err := up.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != p {
+			t.Fatalf("upstream got %q, %v, want %q", buf[:n], err, p)
+		}
+	}
+	// one write for handshake, one for all packets.
+	if n := wc.writes.Load(); n != 2 {
+		t.Fatalf("%d tunnel writes, want 2", n)
+	}
+}
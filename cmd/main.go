@@ -9,9 +9,10 @@ import (
 )
 
 type config struct {
-	listen  string
-	server  string
-	verbose bool
+	listen     string
+	server     string
+	verbose    bool
+	readBuffer int
 }
 
 func main() {
@@ -19,6 +20,7 @@ func main() {
 	flag.StringVar(&conf.listen, "l", "", "listen address")
 	flag.StringVar(&conf.server, "s", "", "(client-only) server listen address")
 	flag.BoolVar(&conf.verbose, "v", false, "log verbose info")
+	flag.IntVar(&conf.readBuffer, "rbuf", 0, "(client-only) udp read buffer size in bytes, default system value")
 	flag.Parse()
 
 	if conf.listen == "" {
@@ -66,6 +68,7 @@ func startClient(conf *config) error {
 			}
 			return uot.DefaultOutConn(conn), nil
 		},
+		UDPReadBuffer: conf.readBuffer,
 	}
 	if conf.verbose {
 		client.Logf = log.Printf
@@ -0,0 +1,103 @@
+package uot
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Backoff of Demuxer read loop on temporary errors.
+const (
+	minDemuxBackoff = time.Millisecond * 5
+	maxDemuxBackoff = time.Second
+)
+
+// Demuxer route packets read from a shared PacketConn to registered channels by source address.
+// It's used when a single udp socket receives packets for many clients.
+type Demuxer struct {
+	conn net.PacketConn
+	nat  nat
+	done chan struct{}
+	err  error // stopping the read loop, set before done is closed
+}
+
+// NewDemuxer return a Demuxer reading from conn until conn is closed, or a read fails with a non-temporary error.
+// It backs off on temporary errors, e.g. a read deadline set on conn.
+func NewDemuxer(conn net.PacketConn) *Demuxer {
+	d := &Demuxer{
+		conn: conn,
+		nat:  nat{m: make(map[string]chan []byte)},
+		done: make(chan struct{}),
+	}
+	go d.serve()
+	return d
+}
+
+// Register route packets from source address key to ch.
+// key is the String() of source address. Packets are dropped if ch is full.
+func (d *Demuxer) Register(key string, ch chan []byte) {
+	d.nat.Set(key, ch)
+}
+
+// Unregister stop routing packets from source address key.
+func (d *Demuxer) Unregister(key string) {
+	d.nat.Del(key)
+}
+
+// Close close the underlying conn and wait for the read loop to exit.
+func (d *Demuxer) Close() error {
+	err := d.conn.Close()
+	<-d.done
+	return err
+}
+
+// Err return the error stopping the read loop, nil if it's running or stopped by Close.
+func (d *Demuxer) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+func (d *Demuxer) serve() {
+	defer close(d.done)
+	buf := allocBuf(MaxPacketSize)
+	defer freeBuf(buf)
+	var delay time.Duration
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			var te interface{ Temporary() bool }
+			if !errors.As(err, &te) || !te.Temporary() {
+				d.err = err
+				return
+			}
+			if delay == 0 {
+				delay = minDemuxBackoff
+			} else {
+				delay *= 2
+			}
+			if delay > maxDemuxBackoff {
+				delay = maxDemuxBackoff
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		ch := d.nat.Get(addr.String())
+		if ch == nil {
+			continue // no route, drop
+		}
+		b := make([]byte, n)
+		copy(b, buf)
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package uot
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDemuxerRoutes(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDemuxer(conn)
+	defer d.Close()
+
+	var peers [2]net.PacketConn
+	var chs [2]chan []byte
+	for i := range peers {
+		if peers[i], err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		defer peers[i].Close()
+		chs[i] = make(chan []byte, 4)
+		d.Register(peers[i].LocalAddr().String(), chs[i])
+	}
+	for i, p := range peers {
+		for j := 0; j < 3; j++ {
+			if _, err = p.WriteTo([]byte{byte(i), byte(j)}, conn.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i, ch := range chs {
+		for j := 0; j < 3; j++ {
+			select {
+			case b := <-ch:
+				if b[0] != byte(i) {
+					t.Fatalf("stream %d got packet of stream %d", i, b[0])
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("stream %d got %d packets, want 3", i, j)
+			}
+		}
+	}
+}
+
+// errPacketConn is a PacketConn whose reads fail with err.
+type errPacketConn struct {
+	net.PacketConn
+	err error
+}
+
+func (c *errPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, c.err
+}
+
+func TestDemuxerStopsOnError(t *testing.T) {
+	boom := errors.New("boom")
+	d := NewDemuxer(&errPacketConn{err: boom})
+	<-d.done
+	if err := d.Err(); err != boom {
+		t.Fatalf("Err = %v, want %v", err, boom)
+	}
+}
@@ -0,0 +1,110 @@
+package uot
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// resolveCacheTTL is how long resolved domain ips are cached.
+const resolveCacheTTL = time.Second * 10
+
+// resolveCache cache domain lookups to avoid resolve storms.
+var resolveCache = struct {
+	mutex sync.Mutex
+	m     map[resolveKey]resolveEntry
+	swept time.Time // expired entries are swept at most once per resolveCacheTTL
+}{m: make(map[resolveKey]resolveEntry)}
+
+// resolveKey is a host looked up by a resolver, resolvers may answer differently.
+type resolveKey struct {
+	r    *net.Resolver
+	host string
+}
+
+type resolveEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// lookupIP return ips of host looked up by r, cached for resolveCacheTTL.
+func lookupIP(ctx context.Context, host string, r *net.Resolver) ([]net.IP, error) {
+	key := resolveKey{r, host}
+	now := time.Now()
+	resolveCache.mutex.Lock()
+	entry, ok := resolveCache.m[key]
+	resolveCache.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ips, nil
+	}
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	resolveCache.mutex.Lock()
+	defer resolveCache.mutex.Unlock()
+	if now.Sub(resolveCache.swept) > resolveCacheTTL {
+		for k, e := range resolveCache.m {
+			if now.After(e.expires) {
+				delete(resolveCache.m, k)
+			}
+		}
+		resolveCache.swept = now
+	}
+	resolveCache.m[key] = resolveEntry{ips, now.Add(resolveCacheTTL)}
+	return ips, nil
+}
+
+// endpoint return ips and port of addr, resolving domain name by r.
+func (addr SocksAddr) endpoint(ctx context.Context, r *net.Resolver) ([]net.IP, int, error) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, 0, err
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	if addr[0] != atypDomainName {
+		return []net.IP{net.ParseIP(host)}, portnum, nil
+	}
+	ips, err := lookupIP(ctx, host, r)
+	return ips, portnum, err
+}
+
+// SameEndpoint report whether addr and other are the same endpoint after resolving domain names,
+// e.g. to treat a domain and its ip as the same flow. Domains resolving to several ips are the same
+// endpoint if any ip is shared. Resolutions are cached briefly per resolver. nil r uses net.DefaultResolver.
+func (addr SocksAddr) SameEndpoint(ctx context.Context, other SocksAddr, r *net.Resolver) (bool, error) {
+	if string(addr.Canonicalize()) == string(other.Canonicalize()) {
+		return true, nil
+	}
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, port, err := addr.endpoint(ctx, r)
+	if err != nil {
+		return false, err
+	}
+	otherIPs, otherPort, err := other.endpoint(ctx, r)
+	if err != nil {
+		return false, err
+	}
+	if port != otherPort {
+		return false, nil
+	}
+	for _, ip := range ips {
+		for _, otherIP := range otherIPs {
+			if ip.Equal(otherIP) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,46 @@
+package uot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSameEndpoint(t *testing.T) {
+	ctx := context.Background()
+	// localhost resolves from hosts file, no dns needed.
+	r := &net.Resolver{PreferGo: true}
+	same, err := ParseSocksAddr("localhost:53").SameEndpoint(ctx, ParseSocksAddr("127.0.0.1:53"), r)
+	if err != nil || !same {
+		t.Fatalf("localhost and 127.0.0.1 SameEndpoint = %v, %v, want true", same, err)
+	}
+	same, err = ParseSocksAddr("localhost:53").SameEndpoint(ctx, ParseSocksAddr("127.0.0.1:54"), r)
+	if err != nil || same {
+		t.Fatalf("different ports SameEndpoint = %v, %v, want false", same, err)
+	}
+	same, err = ParseSocksAddr("Localhost.:53").SameEndpoint(ctx, ParseSocksAddr("localhost:53"), r)
+	if err != nil || !same {
+		t.Fatalf("canonically equal domains SameEndpoint = %v, %v, want true", same, err)
+	}
+}
+
+func TestLookupIPCachePerResolver(t *testing.T) {
+	errDial := errors.New("no dns")
+	cached := &net.Resolver{PreferGo: true}
+	other := &net.Resolver{PreferGo: true, Dial: func(context.Context, string, string) (net.Conn, error) {
+		return nil, errDial
+	}}
+	const host = "cached.invalid"
+	resolveCache.mutex.Lock()
+	resolveCache.m[resolveKey{cached, host}] = resolveEntry{[]net.IP{net.IPv4(192, 0, 2, 1)}, time.Now().Add(time.Minute)}
+	resolveCache.mutex.Unlock()
+
+	if ips, err := lookupIP(context.Background(), host, cached); err != nil || len(ips) != 1 {
+		t.Fatalf("lookupIP by the caching resolver = %v, %v, want the cached ip", ips, err)
+	}
+	if ips, err := lookupIP(context.Background(), host, other); err == nil {
+		t.Fatalf("lookupIP by another resolver = %v, want its own lookup to fail", ips)
+	}
+}
@@ -0,0 +1,33 @@
+package uot
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// enableRxqOvfl set SO_RXQ_OVFL on rc, so the kernel attaches its drop counter to received packets.
+func enableRxqOvfl(rc syscall.RawConn) error {
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// parseRxqOvfl return the drop counter in control messages oob, false if there's none.
+// The kernel attaches it only after the first drop.
+func parseRxqOvfl(oob []byte) (uint32, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			return *(*uint32)(unsafe.Pointer(&m.Data[0])), true // native endian
+		}
+	}
+	return 0, false
+}
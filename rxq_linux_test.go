@@ -0,0 +1,54 @@
+package uot
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReceiveErrors(t *testing.T) {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	conn := DefaultPacketConn(uc).(*defaultPacketConn)
+	if drops, err := conn.ReceiveErrors(); err != nil || drops != 0 {
+		t.Fatalf("ReceiveErrors = %d, %v, want 0, nil", drops, err)
+	}
+	if err = uc.SetReadBuffer(1); err != nil { // kernel rounds it up to its minimum
+		t.Fatal(err)
+	}
+
+	sender, err := net.DialUDP("udp", nil, uc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	packet := append([]byte{0, 0, 0}, ParseSocksAddr("1.2.3.4:53")...)
+	packet = append(packet, make([]byte, 1000)...)
+	// overflow the receive buffer, then drain it, the next packet carries the drop counter.
+	for i := 0; i < 256; i++ {
+		sender.Write(packet)
+	}
+	buf := make([]byte, 2048)
+	for {
+		uc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, _, err = conn.ReadPacket(buf); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal(err)
+	}
+	uc.SetReadDeadline(time.Now().Add(time.Second))
+	sender.Write(packet)
+	if _, _, _, err = conn.ReadPacket(buf); err != nil {
+		t.Fatal(err)
+	}
+	if drops, err := conn.ReceiveErrors(); err != nil || drops == 0 {
+		t.Fatalf("ReceiveErrors = %d, %v, want drops after overflow", drops, err)
+	}
+}
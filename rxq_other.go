@@ -0,0 +1,13 @@
+//go:build !linux
+
+package uot
+
+import "syscall"
+
+func enableRxqOvfl(rc syscall.RawConn) error {
+	return ErrUnsupported
+}
+
+func parseRxqOvfl(oob []byte) (uint32, bool) {
+	return 0, false
+}
@@ -3,14 +3,99 @@ package uot
 import (
 	"errors"
 	"net"
+	"net/netip"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrBlockedTarget is returned when target address is blocked by Server policy.
+var ErrBlockedTarget = errors.New("target address blocked")
+
+// ErrResolveBusy is returned when a target resolution waits over Server.ResolveQueueTimeout for a slot.
+var ErrResolveBusy = errors.New("too many concurrent resolves")
+
+// resolveQueueTimeout is default Server.ResolveQueueTimeout.
+const resolveQueueTimeout = time.Second * 5
+
+// errBadRewrite is returned when RewriteTarget returns a malformed socks address.
+var errBadRewrite = errors.New("rewritten target is not a socks address")
+
+// ErrNoFlow is returned by CloseFlow when no flow matches the target.
+var ErrNoFlow = errors.New("no flow to target")
+
 // Server server.
 type Server struct {
 	// Logf is log func, default nil, no log output.
 	Logf func(string, ...interface{})
+	// BlockPrivateTargets refuses to relay to private, shared (CGNAT), loopback, link-local, multicast,
+	// reserved and unspecified addresses, including IPv4 ones embedded in IPv6.
+	// Domain targets are checked after resolving. It protects internal network from untrusted clients (SSRF).
+	BlockPrivateTargets bool
+	// StrictReplySource drops upstream packets not sent from the target address.
+	// By default, every client connection gets its own upstream udp socket, which keeps the same port
+	// for the whole connection, and packets from any peer to that port are relayed back to client.
+	// That is endpoint-independent (full-cone) NAT behavior real-time apps like WebRTC depend on,
+	// but anyone learning the port can send packets to the client.
+	StrictReplySource bool
+	// ReplySource puts source address of each upstream packet in front of its payload, as a socks address.
+	// Client.ReplySource must be the same, so client app sees the real source of each reply.
+	ReplySource bool
+	// ReplySourceIDs sends each source address once per flow, with an id later replies from it carry instead.
+	// It saves up to 19 bytes per reply, most replies come from the target. It needs ReplySource,
+	// and Client.ReplySourceIDs must be the same.
+	ReplySourceIDs bool
+	// ReplyBufSize is size of upstream read buffer of each flow, default MaxPacketSize.
+	// It's the max reply size, smaller saves memory on memory-constrained relays.
+	// It's capped to what a single packet of the client conn carries after the reply source address.
+	ReplyBufSize int
+	// DropOversizedReplies drops replies larger than ReplyBufSize, default truncates them.
+	DropOversizedReplies bool
+	// MaxConcurrentResolves caps concurrent domain resolutions of targets, default 0, no limit.
+	// It protects DNS from a flood of domain handshakes.
+	MaxConcurrentResolves int
+	// ResolveQueueTimeout is how long a resolution waits for a slot before failing with ErrResolveBusy, default 5s.
+	ResolveQueueTimeout time.Duration
+	// RewriteTarget rewrites target of each flow after handshake and before resolving, e.g. to redirect
+	// a domain to a specific ip. Policies, logs and CloseFlow see the rewritten target. Returning error rejects the flow.
+	RewriteTarget func(SocksAddr) (SocksAddr, error)
+	// OnBadHandshake is called when handshake fails, e.g. a malformed target address from a probe.
+	OnBadHandshake func(remote net.Addr, err error)
+
+	badHandshakes atomic.Uint64
+	resolveOnce   sync.Once
+	resolveSem    chan struct{}
+	flowMutex     sync.Mutex
+	flows         map[string]map[*flow]struct{} // target socks addr -> relaying flows
+}
+
+// Id byte in front of reply source with ReplySourceIDs, see protocol define of defaultConn.
+const (
+	maxReplySourceIDs = 0x7f // ids assigned per flow, from 0 to 0x7e
+	replySourceDefine = 0x80 // replySourceDefine|id is followed by the source assigned id
+	replySourceInline = 0xff // followed by a source not assigned an id, after ids ran out
+)
+
+// errReplySourceID is returned when a reply refers to a source id not assigned.
+var errReplySourceID = errors.New("unknown reply source id")
+
+// flow is a relaying client connection and its upstream socket.
+type flow struct {
+	conn Conn
+	rc   net.PacketConn
+}
+
+// BadHandshakes return count of failed handshakes.
+func (s *Server) BadHandshakes() uint64 {
+	return s.badHandshakes.Load()
+}
+
+func (s *Server) replyBufSize() int {
+	if s.ReplyBufSize > 0 && s.ReplyBufSize < MaxPacketSize {
+		return s.ReplyBufSize
+	}
+	return MaxPacketSize
 }
 
 func (s *Server) logf(format string, v ...interface{}) {
@@ -19,44 +104,241 @@ func (s *Server) logf(format string, v ...interface{}) {
 	}
 }
 
+// connLogf is logf prefixed with id of conn, see ConnOptions.ID.
+func (s *Server) connLogf(conn Conn, format string, v ...interface{}) {
+	if id := connID(conn); id != "" {
+		s.logf("[%s] "+format, append([]interface{}{id}, v...)...)
+		return
+	}
+	s.logf(format, v...)
+}
+
 // Serve read packet over tcp connection and send to target address in udp.
 // read response from target address and send to address on the connection.
 func (s *Server) Serve(conn Conn) error {
 	// handshake, read target addr.
 	addr, err := conn.Handshake(nil)
 	if err != nil {
-		s.logf("handshake error: %s", err)
+		s.connLogf(conn, "handshake error: %s", err)
+		s.badHandshakes.Add(1)
+		if s.OnBadHandshake != nil {
+			s.OnBadHandshake(conn.RemoteAddr(), err)
+		}
+		return err
+	}
+	if s.RewriteTarget != nil {
+		addr, err = s.rewrite(addr)
+		if err != nil {
+			s.connLogf(conn, "rewrite %s error: %s", addr.String(), err)
+			return err
+		}
+	}
+	udpAddr, err := s.resolve(addr)
+	if err != nil {
+		s.connLogf(conn, "resolve %s error: %s", addr.String(), err)
 		return err
 	}
 	rc, err := net.ListenPacket("udp", "")
 	if err != nil {
-		s.logf("listen error: %s", err)
+		s.connLogf(conn, "listen error: %s", err)
 		return err
 	}
-	s.logf("%s <---> %s", conn.RemoteAddr().String(), addr.String())
-	err = s.relay(conn, rc, addr)
+	defer rc.Close()
+	key := flowKey(addr)
+	f := &flow{conn, rc}
+	s.addFlow(key, f)
+	defer s.delFlow(key, f)
+	s.connLogf(conn, "%s <---> %s", conn.RemoteAddr().String(), addr.String())
+	err = s.relay(conn, rc, udpAddr)
 	if err != nil {
-		s.logf("relay error: %s", err)
+		s.connLogf(conn, "relay error: %s", err)
 	}
 	return err
 }
 
-// relay copy between tcp and udp conn until timeout.
-func (s *Server) relay(conn Conn, rc net.PacketConn, addr net.Addr) error {
+// CloseFlow close all flows relaying to target, e.g. to enforce a new policy on a live flow.
+// Targets are compared canonically, see SocksAddr.Canonicalize, so "Example.com:53" matches flows to "example.com:53".
+// It returns ErrNoFlow if there's no such flow.
+func (s *Server) CloseFlow(target SocksAddr) error {
+	if len(target) == 0 {
+		return ErrNoFlow
+	}
+	s.flowMutex.Lock()
+	defer s.flowMutex.Unlock()
+
+	flows := s.flows[string(target.Canonicalize())]
+	if len(flows) == 0 {
+		return ErrNoFlow
+	}
+	for f := range flows {
+		f.conn.Close()
+		f.rc.Close()
+	}
+	return nil
+}
+
+func (s *Server) addFlow(key string, f *flow) {
+	s.flowMutex.Lock()
+	defer s.flowMutex.Unlock()
+
+	if s.flows == nil {
+		s.flows = make(map[string]map[*flow]struct{})
+	}
+	if s.flows[key] == nil {
+		s.flows[key] = make(map[*flow]struct{})
+	}
+	s.flows[key][f] = struct{}{}
+}
+
+func (s *Server) delFlow(key string, f *flow) {
+	s.flowMutex.Lock()
+	defer s.flowMutex.Unlock()
+
+	delete(s.flows[key], f)
+	if len(s.flows[key]) == 0 {
+		delete(s.flows, key)
+	}
+}
+
+// flowKey return the canonical socks addr bytes of target as flow map key.
+// Handshake target is canonical already, but RewriteTarget may return any encoding.
+func flowKey(addr net.Addr) string {
+	socksAddr, err := resloveSocksAddr(addr)
+	if err != nil {
+		return addr.String()
+	}
+	return string(socksAddr.Canonicalize())
+}
+
+// rewrite return target address rewritten by RewriteTarget. It returns addr itself with error.
+func (s *Server) rewrite(addr net.Addr) (net.Addr, error) {
+	target, err := resloveSocksAddr(addr)
+	if err != nil {
+		return addr, err
+	}
+	target, err = s.RewriteTarget(target)
+	if err != nil {
+		return addr, err
+	}
+	if _, n, err := SplitSocksAddr(target); err != nil || n != len(target) {
+		return addr, errBadRewrite
+	}
+	return targetAddr(target), nil
+}
+
+// resolve resolve target address and check it against policy.
+func (s *Server) resolve(addr net.Addr) (*net.UDPAddr, error) {
 	udpAddr, ok := addr.(*net.UDPAddr)
 	if !ok {
-		var err error
+		release, err := s.acquireResolve(addr)
+		if err != nil {
+			return nil, err
+		}
 		udpAddr, err = net.ResolveUDPAddr(addr.Network(), addr.String())
+		release()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	if s.BlockPrivateTargets && isPrivateIP(udpAddr.IP) {
+		return nil, ErrBlockedTarget
+	}
+	return udpAddr, nil
+}
 
+// acquireResolve wait for a slot of MaxConcurrentResolves if addr is a domain name.
+// It returns a func to release the slot.
+func (s *Server) acquireResolve(addr net.Addr) (func(), error) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	if s.MaxConcurrentResolves <= 0 || net.ParseIP(host) != nil {
+		return func() {}, nil
+	}
+	s.resolveOnce.Do(func() {
+		s.resolveSem = make(chan struct{}, s.MaxConcurrentResolves)
+	})
+	t := time.NewTimer(s.resolveQueueTimeout())
+	defer t.Stop()
+	select {
+	case s.resolveSem <- struct{}{}:
+		return func() { <-s.resolveSem }, nil
+	case <-t.C:
+		return nil, ErrResolveBusy
+	}
+}
+
+func (s *Server) resolveQueueTimeout() time.Duration {
+	if s.ResolveQueueTimeout > 0 {
+		return s.ResolveQueueTimeout
+	}
+	return resolveQueueTimeout
+}
+
+// privatePrefixes is address ranges not on the public internet, denied by BlockPrivateTargets.
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("10.0.0.0/8"),      // RFC 1918
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space, CGNAT and cloud internal networks
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local
+	netip.MustParsePrefix("172.16.0.0/12"),   // RFC 1918
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.168.0.0/16"),  // RFC 1918
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and broadcast 255.255.255.255
+	netip.MustParsePrefix("::/128"),          // unspecified
+	netip.MustParsePrefix("::1/128"),         // loopback
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("fc00::/7"),        // ULA
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// Prefixes of IPv6 addresses embedding an IPv4 address, checked by the embedded one.
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96") // embedded in the last 4 bytes
+	sixToFour   = netip.MustParsePrefix("2002::/16")    // embedded in bytes 2 to 6
+)
+
+// isPrivateIP report whether ip is not a public internet address, see privatePrefixes.
+// IPv4-mapped, NAT64 and 6to4 addresses are checked by the IPv4 address they embed. An invalid ip is private.
+func isPrivateIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	b := addr.As16()
+	switch {
+	case nat64Prefix.Contains(addr):
+		addr = netip.AddrFrom4([4]byte(b[12:16]))
+	case sixToFour.Contains(addr):
+		addr = netip.AddrFrom4([4]byte(b[2:6]))
+	}
+	for _, p := range privatePrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// relay copy between tcp and udp conn until timeout.
+func (s *Server) relay(conn Conn, rc net.PacketConn, udpAddr *net.UDPAddr) error {
 	done := make(chan error, 1)
 	// relay from tcp to udp
 	go func() {
 		defer rc.SetReadDeadline(time.Now()) // wake up anthoer goroutine
-		buf := make([]byte, MaxPacketSize)
+		buf := allocBuf(MaxPacketSize)
+		defer freeBuf(buf)
 		for {
 			n, err := conn.Read(buf)
 			if err != nil {
@@ -74,13 +356,45 @@ func (s *Server) relay(conn Conn, rc net.PacketConn, addr net.Addr) error {
 	// relay from udp to tcp
 	var err error
 	var n int
-	buf := make([]byte, MaxPacketSize)
+	var from net.Addr
+	// with ReplySource, source address is put in front of payload, reserve space for it.
+	var head int
+	var ids map[netip.AddrPort]byte // source -> id, with ReplySourceIDs
+	if s.ReplySource {
+		head = 1 + net.IPv6len + 2
+		if s.ReplySourceIDs {
+			head++
+			ids = make(map[netip.AddrPort]byte)
+		}
+	}
+	// a reply must fit in a single packet of conn after the source address.
+	size := s.replyBufSize()
+	if max := maxFramePayload(conn) - head; size > max {
+		size = max
+	}
+	buf := allocBuf(head + size + 1) // one more byte to detect oversized replies
+	defer freeBuf(buf)
 	for {
-		n, _, err = rc.ReadFrom(buf)
+		n, from, err = rc.ReadFrom(buf[head:])
 		if err != nil {
 			break
 		}
-		_, err = conn.Write(buf[:n])
+		if n > size {
+			if s.DropOversizedReplies {
+				s.connLogf(conn, "drop oversized packet from %s", from.String())
+				continue
+			}
+			n = size
+		}
+		if s.StrictReplySource && !sameUDPAddr(from, udpAddr) {
+			s.connLogf(conn, "drop packet from %s", from.String())
+			continue
+		}
+		p := buf[head : head+n]
+		if s.ReplySource {
+			p = s.putReplySource(buf[:head+n], head, from.(*net.UDPAddr).AddrPort(), ids)
+		}
+		_, err = conn.Write(p)
 		if err != nil {
 			break
 		}
@@ -97,3 +411,43 @@ func (s *Server) relay(conn Conn, rc net.PacketConn, addr net.Addr) error {
 	}
 	return nil
 }
+
+// putReplySource put source address from in front of payload buf[head:], and return the reply.
+// With ReplySourceIDs, a source already in ids is put as its id only.
+func (s *Server) putReplySource(buf []byte, head int, from netip.AddrPort, ids map[netip.AddrPort]byte) []byte {
+	if !s.ReplySourceIDs {
+		src := SocksAddrFromAddrPort(from)
+		copy(buf[head-len(src):], src)
+		return buf[head-len(src):]
+	}
+	if id, ok := ids[from]; ok {
+		buf[head-1] = id
+		return buf[head-1:]
+	}
+	src := SocksAddrFromAddrPort(from)
+	start := head - len(src) - 1
+	copy(buf[start+1:], src)
+	if len(ids) < maxReplySourceIDs {
+		id := byte(len(ids))
+		ids[from] = id
+		buf[start] = replySourceDefine | id
+	} else {
+		buf[start] = replySourceInline
+	}
+	return buf[start:]
+}
+
+// maxFramePayload return max payload size conn.Write accepts. A Conn not telling it is assumed to take
+// the largest packet head of default Conn.
+func maxFramePayload(conn Conn) int {
+	if c, ok := conn.(interface{ EffectiveMaxPacketSize() int }); ok {
+		return c.EffectiveMaxPacketSize()
+	}
+	return MaxPacketSize - (maxVarintHead + 1)
+}
+
+// sameUDPAddr report whether addr is the same ip and port with udpAddr.
+func sameUDPAddr(addr net.Addr, udpAddr *net.UDPAddr) bool {
+	a, ok := addr.(*net.UDPAddr)
+	return ok && a.Port == udpAddr.Port && a.IP.Equal(udpAddr.IP)
+}
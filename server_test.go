@@ -0,0 +1,265 @@
+package uot
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCloseFlowCanonical(t *testing.T) {
+	var s Server
+	a, b := net.Pipe()
+	defer b.Close()
+	rc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := targetAddr(ParseSocksAddr("example.com:53"))
+	f := &flow{newConn(a, ConnOptions{}, false), rc}
+	s.addFlow(flowKey(target), f)
+
+	if err = s.CloseFlow(ParseSocksAddr("Example.com.:53")); err != nil {
+		t.Fatalf("CloseFlow error = %v", err)
+	}
+	if _, _, err = rc.ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("upstream socket not closed, ReadFrom error = %v", err)
+	}
+	if err = s.CloseFlow(ParseSocksAddr("example.org:53")); err != ErrNoFlow {
+		t.Fatalf("CloseFlow of unknown target error = %v, want ErrNoFlow", err)
+	}
+}
+
+func TestRelayOversizedReply(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		s := Server{DropOversizedReplies: drop}
+		a, b := net.Pipe()
+		conn, peer := newConn(a, ConnOptions{}, false), newConn(b, ConnOptions{}, true)
+		rc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.relay(conn, rc, target.LocalAddr().(*net.UDPAddr))
+
+		// a reply of MaxPacketSize bytes fits no packet of conn.
+		if _, err = target.WriteTo(make([]byte, MaxPacketSize), rc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = target.WriteTo([]byte("small"), rc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, MaxPacketSize)
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatalf("drop %v: Read error = %v", drop, err)
+		}
+		if !drop {
+			if want := conn.EffectiveMaxPacketSize(); n != want {
+				t.Fatalf("truncated reply is %d bytes, want %d", n, want)
+			}
+			n, err = peer.Read(buf)
+			if err != nil {
+				t.Fatalf("Read after truncated reply error = %v", err)
+			}
+		}
+		if string(buf[:n]) != "small" {
+			t.Fatalf("drop %v: got %d bytes reply, want the small one", drop, n)
+		}
+		peer.Close()
+		rc.Close()
+		target.Close()
+	}
+}
+
+func TestReplySourceIDs(t *testing.T) {
+	s := Server{ReplySource: true, ReplySourceIDs: true}
+	c := Client{ReplySource: true, ReplySourceIDs: true}
+	ids := make(map[netip.AddrPort]byte)
+	var srcs []net.Addr
+	const head = 1 + 1 + net.IPv6len + 2
+	var sent int // bytes of source prefixes sent
+	for i := 0; i < 2*maxReplySourceIDs; i++ {
+		// most replies come from the target, the rest from a new source each.
+		from := netip.MustParseAddrPort("192.0.2.1:53")
+		if i%2 == 1 {
+			from = netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)}), 53)
+		}
+		buf := append(make([]byte, head), "reply"...)
+		p := s.putReplySource(buf, head, from, ids)
+		sent += len(p) - len("reply")
+
+		payload, src, next, err := c.splitReplySource(append([]byte(nil), p...), srcs)
+		if err != nil {
+			t.Fatalf("reply %d: splitReplySource error = %v", i, err)
+		}
+		srcs = next
+		if string(payload) != "reply" || src.String() != from.String() {
+			t.Fatalf("reply %d: got %q from %s, want from %s", i, payload, src, from)
+		}
+	}
+	// the target is sent once with its id, then as the id only. Other sources take the other ids,
+	// and the one left when ids run out is sent inline.
+	ipv4 := len(SocksAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:53")))
+	target := (1 + ipv4) + (maxReplySourceIDs - 1)
+	others := maxReplySourceIDs * (1 + ipv4)
+	if want := target + others; sent != want {
+		t.Fatalf("sent %d bytes of sources, want %d", sent, want)
+	}
+
+	if _, _, _, err := c.splitReplySource([]byte{5, 'x'}, nil); err != errReplySourceID {
+		t.Fatalf("splitReplySource of unassigned id error = %v, want errReplySourceID", err)
+	}
+}
+
+func TestRewriteTarget(t *testing.T) {
+	up, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	s := Server{RewriteTarget: func(SocksAddr) (SocksAddr, error) {
+		return ParseSocksAddr(up.LocalAddr().String()), nil
+	}}
+	a, b := net.Pipe()
+	go s.Serve(DefaultInConn(a))
+	c := DefaultOutConn(b)
+	defer c.Close()
+
+	if _, err = c.Handshake(targetAddr(ParseSocksAddr("rewrite.invalid:53"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	up.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, _, err := up.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("rewritten target got %q, %v", buf[:n], err)
+	}
+}
+
+func TestRewriteTargetMalformed(t *testing.T) {
+	for _, bad := range []SocksAddr{nil, {}, {atypIPv4, 1, 2}, append(ParseSocksAddr("1.2.3.4:53"), 0)} {
+		s := Server{RewriteTarget: func(SocksAddr) (SocksAddr, error) { return bad, nil }}
+		a, b := net.Pipe()
+		go DefaultOutConn(b).Handshake(targetAddr(ParseSocksAddr("example.com:53")))
+		if err := s.Serve(DefaultInConn(a)); err != errBadRewrite {
+			t.Errorf("Serve with rewrite to %x error = %v, want errBadRewrite", bad, err)
+		}
+		b.Close()
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		private bool
+	}{
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+		{"2001:4860:4860::8888", false},
+		{"64:ff9b::808:808", false}, // NAT64 of 8.8.8.8
+		{"2002:808:808::1", false},  // 6to4 of 8.8.8.8
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"224.0.0.251", true},
+		{"239.255.255.250", true},
+		{"255.255.255.255", true},
+		{"::", true},
+		{"::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a00:1", true},   // NAT64 of 10.0.0.1
+		{"64:ff9b::7f00:1", true},  // NAT64 of 127.0.0.1
+		{"2002:c0a8:101::1", true}, // 6to4 of 192.168.1.1
+		{"fd00::1", true},          // ULA
+		{"fe80::1", true},          // link-local
+		{"ff02::1", true},          // multicast
+		{"ff0e::1", true},          // global multicast
+	}
+	for _, tt := range tests {
+		if got := isPrivateIP(net.ParseIP(tt.ip)); got != tt.private {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", tt.ip, got, tt.private)
+		}
+	}
+	if !isPrivateIP(nil) {
+		t.Error("isPrivateIP(nil) = false, want true")
+	}
+}
+
+func TestBlockPrivateTargets(t *testing.T) {
+	s := Server{BlockPrivateTargets: true}
+	if _, err := s.resolve(targetAddr(ParseSocksAddr("100.64.0.1:53"))); err != ErrBlockedTarget {
+		t.Fatalf("resolve of a CGNAT target error = %v, want ErrBlockedTarget", err)
+	}
+	if _, err := s.resolve(&net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}); err != nil {
+		t.Fatalf("resolve of a public target error = %v", err)
+	}
+}
+
+func TestMaxConcurrentResolves(t *testing.T) {
+	s := Server{MaxConcurrentResolves: 2, ResolveQueueTimeout: 10 * time.Millisecond}
+	domain := targetAddr(ParseSocksAddr("example.com:53"))
+	var releases []func()
+	for i := 0; i < s.MaxConcurrentResolves; i++ {
+		release, err := s.acquireResolve(domain)
+		if err != nil {
+			t.Fatalf("acquire %d error = %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := s.acquireResolve(domain); err != ErrResolveBusy {
+		t.Fatalf("acquire over the cap error = %v, want ErrResolveBusy", err)
+	}
+	// ip literals need no resolution and never wait for a slot.
+	release, err := s.acquireResolve(targetAddr(ParseSocksAddr("1.2.3.4:53")))
+	if err != nil {
+		t.Fatalf("acquire of ip target error = %v", err)
+	}
+	release()
+
+	releases[0]()
+	if release, err = s.acquireResolve(domain); err != nil {
+		t.Fatalf("acquire after release error = %v", err)
+	}
+	release()
+	releases[1]()
+}
+
+func TestBadHandshake(t *testing.T) {
+	var hookErrs []error
+	s := Server{OnBadHandshake: func(remote net.Addr, err error) { hookErrs = append(hookErrs, err) }}
+	for _, probe := range [][]byte{
+		{0x09, 1, 2, 3},  // unknown address type
+		{atypIPv4, 1, 2}, // truncated address
+	} {
+		a, b := net.Pipe()
+		go func() {
+			b.Write(probe)
+			b.Close()
+		}()
+		if err := s.Serve(DefaultInConn(a)); err == nil {
+			t.Fatalf("Serve of probe %x succeeded", probe)
+		}
+	}
+	if n := s.BadHandshakes(); n != 2 {
+		t.Fatalf("BadHandshakes = %d, want 2", n)
+	}
+	if len(hookErrs) != 2 || hookErrs[0] == nil || hookErrs[1] == nil {
+		t.Fatalf("OnBadHandshake got %v, want 2 errors", hookErrs)
+	}
+}
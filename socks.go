@@ -2,11 +2,20 @@ package uot
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+// ErrShortAddr is returned by SplitSocksAddr when b does not contain a complete address yet.
+// In streaming parsing, read more data and retry.
+var ErrShortAddr = errors.New("short socks address")
+
 // maxAddrLen is the max size of socks address host in bytes.
 const maxAddrLen = 1 + 1 + 255
 
@@ -17,9 +26,60 @@ const (
 	atypIPv6       = 4
 )
 
+// socks version and reply code. see RFC 1928 section 6.
+const (
+	socksVersion   = 5
+	socksSucceeded = 0
+)
+
+// AddrType is socks address type.
+type AddrType byte
+
+// socks address types, same as atyp values.
+const (
+	AddrTypeIPv4       AddrType = atypIPv4
+	AddrTypeDomainName AddrType = atypDomainName
+	AddrTypeIPv6       AddrType = atypIPv6
+)
+
 // SocksAddr is socks addr defined in RFC 1928.
 type SocksAddr []byte
 
+// UnspecifiedSocksAddr return 0.0.0.0:0 for AddrTypeIPv4 or [::]:0 for AddrTypeIPv6, nil for other types.
+// It's useful as a placeholder target.
+func UnspecifiedSocksAddr(family AddrType) SocksAddr {
+	var addr SocksAddr
+	switch family {
+	case AddrTypeIPv4:
+		addr = make([]byte, 1+net.IPv4len+2)
+	case AddrTypeIPv6:
+		addr = make([]byte, 1+net.IPv6len+2)
+	default:
+		return nil
+	}
+	addr[0] = byte(family)
+	return addr
+}
+
+// Type return address type.
+func (addr SocksAddr) Type() AddrType {
+	return AddrType(addr[0])
+}
+
+// IsUnspecified report whether addr is 0.0.0.0:0 or [::]:0.
+func (addr SocksAddr) IsUnspecified() bool {
+	switch addr[0] {
+	case atypIPv4, atypIPv6:
+		for _, b := range addr[1:] {
+			if b != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 // String return address string.
 func (addr SocksAddr) String() string {
 	var host string
@@ -68,10 +128,135 @@ func ReadSocksAddr(r io.Reader) (SocksAddr, error) {
 	n += nn
 	// read 2-byte port
 	nn, err = io.ReadFull(r, buf[n:n+2])
+	if err != nil {
+		return nil, err
+	}
 	n += nn
 	return buf[:n], nil
 }
 
+// SplitSocksAddr slice socks addr from the beginning of b, b may have trailing data such as payload.
+// It returns the addr and n bytes consumed, b[n:] is the trailing data. addr shares memory with b.
+// If b is a truncated address, it returns ErrShortAddr.
+func SplitSocksAddr(b []byte) (SocksAddr, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrShortAddr
+	}
+	var n int
+	switch b[0] {
+	case atypDomainName:
+		if len(b) < 2 {
+			return nil, 0, ErrShortAddr
+		}
+		n = 1 + 1 + int(b[1]) + 2
+	case atypIPv4:
+		n = 1 + net.IPv4len + 2
+	case atypIPv6:
+		n = 1 + net.IPv6len + 2
+	default:
+		return nil, 0, errors.New("error socks address")
+	}
+	if len(b) < n {
+		return nil, 0, ErrShortAddr
+	}
+	return b[:n], n, nil
+}
+
+// errNegativeCount is returned by ReadSocksAddrList and SplitSocksAddrList with a negative count.
+var errNegativeCount = errors.New("negative socks addr count")
+
+// ReadSocksAddrList read count consecutive socks addrs.
+// count may come from the wire, the list grows as addrs are read instead of being allocated for count up front.
+func ReadSocksAddrList(r io.Reader, count int) ([]SocksAddr, error) {
+	if count < 0 {
+		return nil, errNegativeCount
+	}
+	var list []SocksAddr
+	for i := 0; i < count; i++ {
+		addr, err := ReadSocksAddr(r)
+		if err != nil {
+			return nil, fmt.Errorf("socks addr %d: %w", i, err)
+		}
+		list = append(list, addr)
+	}
+	return list, nil
+}
+
+// SplitSocksAddrList slice count consecutive socks addrs from the beginning of b.
+// It returns the addrs and n bytes consumed, see SplitSocksAddr.
+func SplitSocksAddrList(b []byte, count int) ([]SocksAddr, int, error) {
+	if count < 0 {
+		return nil, 0, errNegativeCount
+	}
+	var list []SocksAddr
+	var n int
+	for i := 0; i < count; i++ {
+		addr, m, err := SplitSocksAddr(b[n:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("socks addr %d: %w", i, err)
+		}
+		list = append(list, addr)
+		n += m
+	}
+	return list, n, nil
+}
+
+// ReadSocksAddrStrict read socks addr, and reject what RFC 1928 does not allow.
+// ReadSocksAddr only rejects unknown address type. In addition, strict mode rejects:
+//   - empty domain name.
+//   - domain name with bytes other than printable ASCII, or with space.
+//   - domain name that is an IP literal, which must use IPv4 or IPv6 address type.
+func ReadSocksAddrStrict(r io.Reader) (SocksAddr, error) {
+	addr, err := ReadSocksAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	if addr[0] != atypDomainName {
+		return addr, nil
+	}
+	host := addr[2 : 2+int(addr[1])]
+	if len(host) == 0 {
+		return nil, errors.New("empty socks domain name")
+	}
+	for _, c := range host {
+		if c <= ' ' || c >= 0x7f {
+			return nil, errors.New("invalid socks domain name")
+		}
+	}
+	if net.ParseIP(string(host)) != nil {
+		return nil, errors.New("ip literal in socks domain name")
+	}
+	return addr, nil
+}
+
+// WriteSocksReply write a succeeded socks reply with bind address, see RFC 1928 section 6.
+// e.g. after UDP ASSOCIATE, bind is the address client sends udp packets to.
+// The package has no SOCKS5 TCP control handshake, it's a codec helper for a front-end doing one.
+func WriteSocksReply(w io.Writer, bind SocksAddr) error {
+	buf := make([]byte, 0, 3+len(bind))
+	buf = append(buf, socksVersion, socksSucceeded, 0) // VER REP RSV
+	buf = append(buf, bind...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadSocksReply read a socks reply and return the bind address, see RFC 1928 section 6.
+// It returns error if reply is not succeeded.
+func ReadSocksReply(r io.Reader) (SocksAddr, error) {
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(r, buf) // VER REP RSV
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, errors.New("error socks version")
+	}
+	if buf[1] != socksSucceeded {
+		return nil, errors.New("socks reply failed with code " + strconv.Itoa(int(buf[1])))
+	}
+	return ReadSocksAddr(r)
+}
+
 // ParseSocksAddr parses the address in string s. Returns nil if failed.
 func ParseSocksAddr(s string) SocksAddr {
 	var addr SocksAddr
@@ -108,3 +293,127 @@ func ParseSocksAddr(s string) SocksAddr {
 
 	return addr
 }
+
+// Canonicalize return the canonical encoding of addr, so equal endpoints have equal bytes, e.g. for ACL.
+//   - IPv4-mapped IPv6 is encoded as IPv4 type.
+//   - domain name of an IP literal is encoded as IP type.
+//   - domain name is lower-cased, without trailing dot.
+//
+// It returns addr itself if already canonical.
+func (addr SocksAddr) Canonicalize() SocksAddr {
+	switch addr[0] {
+	case atypIPv6:
+		if net.IP(addr[1:1+net.IPv6len]).To4() == nil {
+			return addr
+		}
+		return ParseSocksAddr(addr.String())
+	case atypDomainName:
+		host := string(addr[2 : 2+int(addr[1])])
+		h := strings.ToLower(strings.TrimSuffix(host, "."))
+		if h == host && net.ParseIP(h) == nil {
+			return addr
+		}
+		_, port, _ := net.SplitHostPort(addr.String())
+		if a := ParseSocksAddr(net.JoinHostPort(h, port)); a != nil {
+			return a
+		}
+	}
+	return addr
+}
+
+// KeyInto write a comparable key of addr into b and return it, b is reused if large enough.
+// It avoids allocation of String() as map key, convert it with string(key) only when storing the key.
+// Equal endpoints have equal keys only if addr is canonical, see Canonicalize.
+func (addr SocksAddr) KeyInto(b []byte) []byte {
+	return append(b[:0], addr...)
+}
+
+// SocksAddrFromAddrPort return socks addr of ap without going through net.IP or string.
+// IPv4 and IPv4-mapped IPv6 addresses are encoded as IPv4 type.
+func SocksAddrFromAddrPort(ap netip.AddrPort) SocksAddr {
+	var addr SocksAddr
+	ip := ap.Addr().Unmap()
+	if ip.Is4() {
+		addr = make([]byte, 1+net.IPv4len+2)
+		addr[0] = atypIPv4
+		b := ip.As4()
+		copy(addr[1:], b[:])
+	} else {
+		addr = make([]byte, 1+net.IPv6len+2)
+		addr[0] = atypIPv6
+		b := ip.As16()
+		copy(addr[1:], b[:])
+	}
+	port := ap.Port()
+	addr[len(addr)-2], addr[len(addr)-1] = byte(port>>8), byte(port)
+	return addr
+}
+
+// AddrPort return netip.AddrPort of addr. It returns false if addr is a domain name.
+func (addr SocksAddr) AddrPort() (netip.AddrPort, bool) {
+	var ip netip.Addr
+	switch addr[0] {
+	case atypIPv4:
+		ip = netip.AddrFrom4([4]byte(addr[1 : 1+net.IPv4len]))
+	case atypIPv6:
+		ip = netip.AddrFrom16([16]byte(addr[1 : 1+net.IPv6len]))
+	default:
+		return netip.AddrPort{}, false
+	}
+	buf := addr[len(addr)-2:]
+	port := uint16(buf[0])<<8 | uint16(buf[1])
+	return netip.AddrPortFrom(ip, port), true
+}
+
+// schemePorts is default port of supported url schemes, empty means port is required.
+var schemePorts = map[string]string{
+	"udp": "",
+	"dns": "53",
+	"ntp": "123",
+}
+
+// SocksAddrFromURL return socks addr of url host and port, e.g. udp://example.com:53.
+// Port can be omitted only if the scheme has a default port.
+func SocksAddrFromURL(u *url.URL) (SocksAddr, error) {
+	defaultPort, ok := schemePorts[u.Scheme]
+	if !ok {
+		return nil, errors.New("unsupported url scheme: " + u.Scheme)
+	}
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return nil, errors.New("missing host in url")
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	if port == "" {
+		return nil, errors.New("missing port in url")
+	}
+	addr := ParseSocksAddr(net.JoinHostPort(host, port))
+	if addr == nil {
+		return nil, errors.New("invalid url address")
+	}
+	return addr, nil
+}
+
+// internedAddrs store canonical instances of interned socks addrs.
+var internedAddrs = struct {
+	mutex sync.Mutex
+	m     map[string]SocksAddr
+}{m: make(map[string]SocksAddr)}
+
+// InternSocksAddr return a shared canonical instance equal to addr.
+// Equal addresses share the same backing array, so the returned addr must not be modified.
+// Interned addresses are never released, use it only for a small set of targets.
+func InternSocksAddr(addr SocksAddr) SocksAddr {
+	internedAddrs.mutex.Lock()
+	defer internedAddrs.mutex.Unlock()
+
+	if a, ok := internedAddrs.m[string(addr)]; ok {
+		return a
+	}
+	a := make(SocksAddr, len(addr))
+	copy(a, addr)
+	internedAddrs.m[string(a)] = a
+	return a
+}
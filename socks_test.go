@@ -0,0 +1,148 @@
+package uot
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net/url"
+	"testing"
+)
+
+func TestSocksAddrList(t *testing.T) {
+	addrs := []SocksAddr{ParseSocksAddr("1.2.3.4:53"), ParseSocksAddr("example.com:123"), ParseSocksAddr("[::1]:80")}
+	var b []byte
+	for _, a := range addrs {
+		b = append(b, a...)
+	}
+
+	list, err := ReadSocksAddrList(bytes.NewReader(b), len(addrs))
+	if err != nil || len(list) != len(addrs) {
+		t.Fatalf("ReadSocksAddrList = %v, %v", list, err)
+	}
+	list, n, err := SplitSocksAddrList(b, len(addrs))
+	if err != nil || len(list) != len(addrs) || n != len(b) {
+		t.Fatalf("SplitSocksAddrList = %v, %d, %v", list, n, err)
+	}
+	for i := range addrs {
+		if !bytes.Equal(list[i], addrs[i]) {
+			t.Fatalf("addr %d is %s, want %s", i, list[i], addrs[i])
+		}
+	}
+
+	if _, err = ReadSocksAddrList(bytes.NewReader(b), -1); err == nil {
+		t.Fatal("ReadSocksAddrList with negative count succeeded")
+	}
+	if _, _, err = SplitSocksAddrList(b, -1); err == nil {
+		t.Fatal("SplitSocksAddrList with negative count succeeded")
+	}
+	// a count off the wire larger than the addrs fails on the short input, without allocating for count.
+	if _, _, err = SplitSocksAddrList(b, math.MaxInt32); !errors.Is(err, ErrShortAddr) {
+		t.Fatalf("SplitSocksAddrList with huge count error = %v, want ErrShortAddr", err)
+	}
+}
+
+func TestSocksReplyExchange(t *testing.T) {
+	bind := ParseSocksAddr("127.0.0.1:1080")
+	var buf bytes.Buffer
+	if err := WriteSocksReply(&buf, bind); err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte{5, 0, 0}, bind...); !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("reply is %x, want %x", buf.Bytes(), want)
+	}
+	got, err := ReadSocksReply(&buf)
+	if err != nil || !bytes.Equal(got, bind) {
+		t.Fatalf("ReadSocksReply = %s, %v, want %s", got, err, bind)
+	}
+
+	// a failed reply, e.g. command not supported.
+	if _, err = ReadSocksReply(bytes.NewReader(append([]byte{5, 7, 0}, bind...))); err == nil {
+		t.Fatal("ReadSocksReply of a failed reply succeeded")
+	}
+	if _, err = ReadSocksReply(bytes.NewReader(append([]byte{4, 0, 0}, bind...))); err == nil {
+		t.Fatal("ReadSocksReply of another socks version succeeded")
+	}
+}
+
+var benchAddrs = []SocksAddr{
+	ParseSocksAddr("1.2.3.4:53"),
+	ParseSocksAddr("[2001:db8::1]:443"),
+	ParseSocksAddr("example.com:123"),
+}
+
+func BenchmarkSocksAddrKey(b *testing.B) {
+	m := make(map[string]int)
+	for i, addr := range benchAddrs {
+		m[string(addr.KeyInto(nil))] = i
+		m[addr.String()] = i
+	}
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = m[benchAddrs[i%len(benchAddrs)].String()]
+		}
+	})
+	b.Run("KeyInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var key []byte
+		for i := 0; i < b.N; i++ {
+			key = benchAddrs[i%len(benchAddrs)].KeyInto(key)
+			_ = m[string(key)]
+		}
+	})
+}
+
+func TestInternSocksAddr(t *testing.T) {
+	in := ParseSocksAddr("intern.example:53")
+	a := InternSocksAddr(in)
+	b := InternSocksAddr(ParseSocksAddr("intern.example:53"))
+	if &a[0] != &b[0] {
+		t.Fatal("equal addrs were interned to different backing arrays")
+	}
+	if &a[0] == &in[0] {
+		t.Fatal("interned addr shares the backing array of the caller")
+	}
+	in[len(in)-1]++ // caller reusing its buffer must not change the interned addr
+	if a.String() != "intern.example:53" {
+		t.Fatalf("interned addr changed to %s", a)
+	}
+	if c := InternSocksAddr(ParseSocksAddr("intern.example:54")); &c[0] == &a[0] {
+		t.Fatal("different addrs were interned to the same backing array")
+	}
+}
+
+func TestSocksAddrFromURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string // empty means error
+	}{
+		{"udp://example.com:53", "example.com:53"},
+		{"udp://1.2.3.4:5353", "1.2.3.4:5353"},
+		{"udp://[2001:db8::1]:443", "[2001:db8::1]:443"},
+		{"dns://[2001:db8::1]", "[2001:db8::1]:53"},
+		{"dns://example.com", "example.com:53"},
+		{"ntp://pool.ntp.org", "pool.ntp.org:123"},
+		{"udp://example.com", ""}, // udp has no default port
+		{"udp://:53", ""},
+		{"http://example.com:80", ""},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := SocksAddrFromURL(u)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("SocksAddrFromURL(%s) = %s, want error", tt.url, addr)
+			}
+			continue
+		}
+		if err != nil || addr.String() != tt.want {
+			t.Errorf("SocksAddrFromURL(%s) = %s, %v, want %s", tt.url, addr, err, tt.want)
+		}
+	}
+	if addr, err := SocksAddrFromURL(&url.URL{Scheme: "udp", Host: "[2001:db8::1]:53"}); err != nil || addr[0] != atypIPv6 {
+		t.Fatalf("ipv6 literal encoded as %x, %v", addr, err)
+	}
+}
@@ -0,0 +1,31 @@
+package uot
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrUnsupported is returned by socket statistics not available on this platform.
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// TransportStats is tcp statistics of the underlying conn, from TCP_INFO.
+// Tunneling udp over tcp suffers from tcp meltdown under loss, where retransmits and rtt grow together,
+// rising TotalRetrans with a growing RTT is the symptom to watch.
+type TransportStats struct {
+	RTT          time.Duration // smoothed round trip time
+	RTTVar       time.Duration // round trip time variance
+	Retransmits  uint32        // retransmits of the segment currently unacknowledged
+	TotalRetrans uint32        // retransmitted segments over the whole connection
+	Lost         uint32        // segments currently considered lost
+	Cwnd         uint32        // congestion window, in segments
+}
+
+// TransportStats return tcp statistics of the underlying conn, only supported on Linux except 386, ErrUnsupported elsewhere.
+// It returns error if the underlying conn is not a tcp conn.
+func (c *defaultConn) TransportStats() (TransportStats, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return TransportStats{}, err
+	}
+	return tcpInfo(rc)
+}
@@ -0,0 +1,34 @@
+//go:build linux && !386
+
+package uot
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// tcpInfo read TCP_INFO of rc. syscall has no getsockopt wrapper for it, so call getsockopt directly.
+func tcpInfo(rc syscall.RawConn) (TransportStats, error) {
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	err := rc.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return TransportStats{}, err
+	}
+	if errno != 0 {
+		return TransportStats{}, errno
+	}
+	return TransportStats{
+		RTT:          time.Duration(info.Rtt) * time.Microsecond,
+		RTTVar:       time.Duration(info.Rttvar) * time.Microsecond,
+		Retransmits:  uint32(info.Retransmits),
+		TotalRetrans: info.Total_retrans,
+		Lost:         info.Lost,
+		Cwnd:         info.Snd_cwnd,
+	}, nil
+}
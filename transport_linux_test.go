@@ -0,0 +1,31 @@
+//go:build linux && !386
+
+package uot
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTransportStats(t *testing.T) {
+	a, b := tcpPair(t)
+	c, peer := newConn(a, ConnOptions{}, true), newConn(b, ConnOptions{}, false)
+	go c.Write([]byte("hello"))
+	if _, err := peer.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := c.TransportStats()
+	if err != nil {
+		t.Fatalf("TransportStats error = %v", err)
+	}
+	if stats.Cwnd == 0 {
+		t.Fatalf("TransportStats = %+v, want a congestion window", stats)
+	}
+
+	p, q := net.Pipe()
+	defer p.Close()
+	defer q.Close()
+	if _, err = newConn(p, ConnOptions{}, true).TransportStats(); err == nil {
+		t.Fatal("TransportStats of a pipe conn succeeded")
+	}
+}
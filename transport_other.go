@@ -0,0 +1,9 @@
+//go:build !linux || 386
+
+package uot
+
+import "syscall"
+
+func tcpInfo(rc syscall.RawConn) (TransportStats, error) {
+	return TransportStats{}, ErrUnsupported
+}
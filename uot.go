@@ -2,15 +2,31 @@ package uot
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // MaxPacketSize is max udp packet payload size.
 // It is 65535 - 20(IP header) - 8(UDP header).
 const MaxPacketSize = 65535 - 20 - 8
 
+// ErrFramingCorrupt is returned by Read when the length check of a packet mismatch.
+var ErrFramingCorrupt = errors.New("framing corrupt")
+
+// ErrEmptyWrite is returned by Write with empty payload if ConnOptions.EmptyWrite is EmptyWriteError.
+var ErrEmptyWrite = errors.New("empty write")
+
+// ErrConnExpired is returned when a Conn is older than ConnOptions.MaxAge. The Conn is closed.
+var ErrConnExpired = errors.New("connection expired")
+
 // Conn is an udp-over-tcp connection.
 type Conn interface {
 	net.Conn
@@ -20,6 +36,21 @@ type Conn interface {
 	Handshake(net.Addr) (net.Addr, error)
 }
 
+// Flusher is implemented by Conn that may buffer written packets.
+type Flusher interface {
+	// Flush writes buffered packets to the underlying conn.
+	Flush() error
+}
+
+// Valuer is implemented by Conn carrying per-connection values, like a default Conn.
+// A wrapper of Conn implements it by forwarding to the wrapped one, so values pass through wrapper chains.
+type Valuer interface {
+	// WithValue attaches a key-value and returns the Conn.
+	WithValue(key, val interface{}) Conn
+	// Value returns the value attached for key, or nil.
+	Value(key interface{}) interface{}
+}
+
 // PacketConn is client side udp connection.
 type PacketConn interface {
 	net.PacketConn
@@ -31,13 +62,123 @@ type PacketConn interface {
 	WritePacket(p []byte, target net.Addr, addr net.Addr) (n int, err error)
 }
 
+// ErrHandshakeMismatch is returned by client side Handshake when server echoes a different target address.
+var ErrHandshakeMismatch = errors.New("handshake address mismatch")
+
+// ErrPartialWrite is returned when a packet was partially written, e.g. a write deadline exceeded.
+// The peer can not find the next packet boundary any more, so all subsequent Write return it.
+var ErrPartialWrite = errors.New("partial packet written, connection broken")
+
+// ErrOverMaxPacketSize is returned when a packet is larger than MaxPacketSize.
+var ErrOverMaxPacketSize = errors.New("over max packet size")
+
+// ErrTrailingBytes is returned by ValidateFrame when bytes follow the packet.
+var ErrTrailingBytes = errors.New("trailing bytes after packet")
+
+// errNoSyscallConn is returned by SyscallConn if the underlying conn does not implement syscall.Conn.
+var errNoSyscallConn = errors.New("underlying conn does not implement syscall.Conn")
+
+// ConnOptions is optional config of default Conn, zero value is the default protocol.
+// Options changing the wire format must be the same on both peers.
+type ConnOptions struct {
+	// LengthCheck appends a 1-byte check, XOR of the size bytes, to the size of each packet.
+	// Read validates it before trusting the size, to detect framing corruption early.
+	LengthCheck bool
+	// Varint encodes size of each packet as a protobuf-style varint instead of 2-byte big-endian,
+	// saving a byte for packets shorter than 128 bytes.
+	Varint bool
+	// EmptyWrite is behavior of Write with empty payload, default EmptyWriteFrame.
+	EmptyWrite EmptyWriteMode
+	// MaxAge is max lifetime of Conn regardless of activity, default 0, no limit.
+	// The first Read or Write after MaxAge closes Conn and returns ErrConnExpired, so the caller reconnects.
+	MaxAge time.Duration
+	// OnFrame is called with payload size of each packet read or written, e.g. to build a size histogram.
+	// It's called in Read and Write, so it must be fast and safe for concurrent use. Default nil.
+	OnFrame func(size int)
+	// WriteTimeout bounds each underlying write of Write and Flush, so a relay never stalls forever on a peer not reading.
+	// It's applied as write deadline before and cleared after, overriding deadline set by SetWriteDeadline.
+	// WriteContext is bounded by the earlier of ctx deadline and WriteTimeout.
+	// Default 0, no timeout.
+	WriteTimeout time.Duration
+	// HandshakeDelay is a settle delay before client side Handshake sends target address, default 0.
+	// Some custom transports return conn before it's ready to write, e.g. an async dialer still connecting,
+	// or a tunnel opening its stream in background. Plain tcp conns from net.Dial never need it.
+	HandshakeDelay time.Duration
+	// HandshakeEcho makes server write the parsed target address back in Handshake,
+	// and client compare it with the sent one, returning ErrHandshakeMismatch if they differ.
+	HandshakeEcho bool
+	// ID identifies Conn in Client and Server logs, e.g. a request id to correlate logs across peers.
+	// It's local only and not sent to peer. Default empty, no prefix.
+	ID string
+}
+
+// EmptyWriteMode is behavior of Write with empty payload.
+type EmptyWriteMode int
+
+const (
+	// EmptyWriteFrame writes a zero-length packet, relayed as an empty udp packet.
+	// Note it collides with keepalive if a custom protocol uses zero-length packet as keepalive.
+	EmptyWriteFrame EmptyWriteMode = iota
+	// EmptyWriteError returns ErrEmptyWrite.
+	EmptyWriteError
+	// EmptyWriteDiscard writes nothing and returns 0, nil.
+	EmptyWriteDiscard
+)
+
 type defaultConn struct {
 	net.Conn
-	isClient bool // is client or server side
+	opts     ConnOptions
+	isClient bool        // is client or server side
+	created  time.Time   // for MaxAge
+	closed   atomic.Bool // Read and Write return net.ErrClosed after Close
+	broken   atomic.Bool // Write returns ErrPartialWrite after a partial write
+	wmutex   sync.Mutex  // protect corked and wbuf
+	corked   bool
+	wbuf     []byte                  // packets written while corked
+	rhead    [maxVarintHead + 1]byte // packet head read by Read, kept out of caller's buffer
+	values   atomic.Pointer[valueNode]
+	label    string // see SetLabel
+	rhlen    int    // head bytes in rhead read by ReadDeadline before a timeout
+	rpart    []byte // payload bytes read by ReadDeadline before a timeout, from allocBuf until the packet completes
+
+	payloadBytes  atomic.Uint64 // payload bytes read and written
+	overheadBytes atomic.Uint64 // packet head bytes read and written
+}
+
+// valueNode is a per-connection key-value, linked to the previous attached one.
+type valueNode struct {
+	key, val interface{}
+	next     *valueNode
+}
+
+var (
+	_ Conn       = (*defaultConn)(nil)
+	_ Flusher    = (*defaultConn)(nil)
+	_ Valuer     = (*defaultConn)(nil)
+	_ PacketConn = (*defaultPacketConn)(nil)
+	_ net.Conn   = (*prereadConn)(nil)
+)
+
+// prereadConn read from r, which prepends already read bytes to conn.
+type prereadConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prereadConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn return the wrapped conn, like tls.Conn.NetConn.
+func (c *prereadConn) NetConn() net.Conn {
+	return c.Conn
 }
 
 type defaultPacketConn struct {
 	net.PacketConn
+	wmutex  sync.RWMutex  // WritePacketDeadline holds it exclusively, so its deadline bounds no other write
+	rxqOvfl atomic.Bool   // SO_RXQ_OVFL enabled by ReceiveErrors
+	drops   atomic.Uint64 // kernel drop counter from the latest read packet
 }
 
 /*
@@ -52,27 +193,65 @@ Request:
 handshake: target address of packet, which is a socks5 address defined in RFC 1928 section 4.
 packet: [size][payload]
 size: 2-byte, length of payload.
+With ConnOptions.Varint, size is an unsigned varint, 1 to 3 bytes.
+With ConnOptions.LengthCheck, size is followed by 1-byte check, XOR of the size bytes.
 payload: raw udp packet.
 
 Response:
 [packet...]
 
 same as Request, but with no handsahke.
+With ConnOptions.HandshakeEcho, Response starts with the canonical handshake address.
+With Client.ReplySource and Server.ReplySource, response payload is [source][payload],
+source is the socks address upstream packet is sent from.
+With Client.ReplySourceIDs and Server.ReplySourceIDs, source is [id] for a source sent before,
+[0x80|id][address] the first time server sees a source, id is assigned from 0 and up to 0x7e,
+or [0xff][address] once ids run out.
 */
 
+func newConn(conn net.Conn, opts ConnOptions, isClient bool) *defaultConn {
+	return &defaultConn{Conn: conn, opts: opts, isClient: isClient, created: time.Now()}
+}
+
 // DefaultOutConn return a default client side Conn.
 func DefaultOutConn(conn net.Conn) Conn {
-	return &defaultConn{conn, true}
+	return newConn(conn, ConnOptions{}, true)
 }
 
 // DefaultInConn return a default server side Conn.
 func DefaultInConn(conn net.Conn) Conn {
-	return &defaultConn{conn, false}
+	return newConn(conn, ConnOptions{}, false)
+}
+
+// NewOutConn return a default client side Conn with options.
+func NewOutConn(conn net.Conn, opts ConnOptions) Conn {
+	return newConn(conn, opts, true)
+}
+
+// NewInConn return a default server side Conn with options.
+func NewInConn(conn net.Conn, opts ConnOptions) Conn {
+	return newConn(conn, opts, false)
+}
+
+// DefaultInConnPreread return a default server side Conn, with buffered bytes already read from conn.
+// It's used when the first bytes was read before handing off, e.g. by a port-sharing front-end.
+// buffered is read before conn, so Handshake parses correctly.
+func DefaultInConnPreread(conn net.Conn, buffered []byte) Conn {
+	return NewInConnPreread(conn, buffered, ConnOptions{})
+}
+
+// NewInConnPreread is DefaultInConnPreread with options, for peers changing the wire format.
+func NewInConnPreread(conn net.Conn, buffered []byte, opts ConnOptions) Conn {
+	if len(buffered) == 0 {
+		return NewInConn(conn, opts)
+	}
+	r := io.MultiReader(bytes.NewReader(buffered), conn)
+	return newConn(&prereadConn{conn, r}, opts, false)
 }
 
 // DefaultPacketConn return a default packet conn.
 func DefaultPacketConn(conn net.PacketConn) PacketConn {
-	return &defaultPacketConn{conn}
+	return &defaultPacketConn{PacketConn: conn}
 }
 
 type targetAddr SocksAddr
@@ -98,84 +277,767 @@ func resloveSocksAddr(addr net.Addr) (SocksAddr, error) {
 }
 
 func (c *defaultPacketConn) ReadPacket(p []byte) (int, net.Addr, net.Addr, error) {
-	n, addr, err := c.PacketConn.ReadFrom(p)
+	n, addr, err := c.readFrom(p)
 	if err != nil {
 		return 0, nil, nil, err
 	}
 	head := 3 // RSV FRAG
-	if len(p) < head {
-		return 0, nil, nil, io.ErrShortBuffer
+	if n < head {
+		return 0, nil, nil, fmt.Errorf("parsing packet header: %w", io.ErrUnexpectedEOF)
 	}
-	target, err := ReadSocksAddr(bytes.NewReader(p[head:n]))
+	target, m, err := SplitSocksAddr(p[head:n])
 	if err != nil {
-		return 0, nil, nil, err
+		return 0, nil, nil, fmt.Errorf("parsing packet address: %w", err)
 	}
-	length := head + len(target)
+	target = append(SocksAddr(nil), target...) // p is overwritten by payload below
+	length := head + m
 	copy(p, p[length:n])
 	return n - length, targetAddr(target), addr, nil
 }
 
+// readFrom is ReadFrom, and updates drops with the counter attached to the packet once ReceiveErrors enabled it.
+func (c *defaultPacketConn) readFrom(p []byte) (int, net.Addr, error) {
+	uc, ok := c.PacketConn.(*net.UDPConn)
+	if !ok || !c.rxqOvfl.Load() {
+		return c.PacketConn.ReadFrom(p)
+	}
+	var oob [64]byte
+	n, oobn, _, addr, err := uc.ReadMsgUDP(p, oob[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if drops, ok := parseRxqOvfl(oob[:oobn]); ok {
+		c.drops.Store(uint64(drops))
+	}
+	return n, addr, nil
+}
+
+// ReceiveErrors return count of packets the kernel dropped because receive buffer of the socket was full.
+// The first call enables SO_RXQ_OVFL, then read packets carry the counter, so the count is as of when the latest read packet arrived.
+// It's only supported on Linux, ErrUnsupported elsewhere, and returns error if the underlying conn is not an udp conn.
+func (c *defaultPacketConn) ReceiveErrors() (uint64, error) {
+	if !c.rxqOvfl.Load() {
+		uc, ok := c.PacketConn.(*net.UDPConn)
+		if !ok {
+			return 0, errors.New("underlying conn is not an udp conn")
+		}
+		rc, err := uc.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		if err = enableRxqOvfl(rc); err != nil {
+			return 0, err
+		}
+		c.rxqOvfl.Store(true)
+	}
+	return c.drops.Load(), nil
+}
+
+// SetReadBuffer forward to SetReadBuffer of the underlying conn, e.g. *net.UDPConn.
+// It returns error if the underlying conn does not support it.
+func (c *defaultPacketConn) SetReadBuffer(bytes int) error {
+	rb, ok := c.PacketConn.(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return errors.New("underlying conn does not support SetReadBuffer")
+	}
+	return rb.SetReadBuffer(bytes)
+}
+
+// WritePacket is safe for concurrent use.
+// Each call builds the packet in its own buffer, nothing is shared between writers.
 func (c *defaultPacketConn) WritePacket(p []byte, target net.Addr, addr net.Addr) (int, error) {
+	c.wmutex.RLock()
+	defer c.wmutex.RUnlock()
+	return c.writePacket(p, target, addr)
+}
+
+func (c *defaultPacketConn) writePacket(p []byte, target net.Addr, addr net.Addr) (int, error) {
 	socksAddr, err := resloveSocksAddr(target)
 	if err != nil {
 		return 0, err
 	}
 	length := len(socksAddr) + len(p) + 3
 	if length > MaxPacketSize {
-		return 0, errors.New("over max package size")
+		return 0, ErrOverMaxPacketSize
 	}
-	buf := make([]byte, 0, length)
-	buf = append(buf, 0, 0, 0) // RSV FRAG
+	buf := allocBuf(length)
+	defer freeBuf(buf)
+	buf = append(buf[:0], 0, 0, 0) // RSV FRAG
 	buf = append(buf, socksAddr...)
 	buf = append(buf, p...)
 
 	return c.PacketConn.WriteTo(buf, addr)
 }
 
+// WritePacketDeadline is WritePacket bounded by write deadline d from now, it clears write deadline after.
+// A relay writing to many clients is not stalled by a slow one.
+// The deadline is of the whole socket, so it waits for concurrent writes and blocks new ones until it's done,
+// plain WritePacket calls are never bounded by it.
+func (c *defaultPacketConn) WritePacketDeadline(p []byte, target net.Addr, addr net.Addr, d time.Duration) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	if err := c.PacketConn.SetWriteDeadline(time.Now().Add(d)); err != nil {
+		return 0, err
+	}
+	defer c.PacketConn.SetWriteDeadline(time.Time{})
+	return c.writePacket(p, target, addr)
+}
+
 func (c *defaultConn) Handshake(addr net.Addr) (net.Addr, error) {
 	if c.isClient {
 		socksAddr, err := resloveSocksAddr(addr)
 		if err != nil {
 			return nil, err
 		}
+		if c.opts.HandshakeDelay > 0 {
+			time.Sleep(c.opts.HandshakeDelay)
+		}
 		_, err = c.Conn.Write(socksAddr)
 		if err != nil {
-			return nil, err
+			return nil, c.stageError("writing handshake address", err)
+		}
+		if c.opts.HandshakeEcho {
+			echo, err := ReadSocksAddr(c.Conn)
+			if err != nil {
+				return nil, c.stageError("reading handshake echo", err)
+			}
+			if string(echo) != string(socksAddr.Canonicalize()) {
+				return nil, ErrHandshakeMismatch
+			}
 		}
 		return addr, nil
 	}
 	a, err := ReadSocksAddr(c.Conn)
 	if err != nil {
-		return nil, err
+		return nil, c.stageError("parsing handshake address", err)
+	}
+	a = a.Canonicalize()
+	if c.opts.HandshakeEcho {
+		_, err = c.Conn.Write(a)
+		if err != nil {
+			return nil, c.stageError("writing handshake echo", err)
+		}
 	}
 	return targetAddr(a), nil
 }
 
+// stageError wrap err with the framing stage it's from, errors.Is still matches the underlying error.
+// A clean io.EOF, before any byte of a packet, is returned as is, as io.Reader requires.
+func (c *defaultConn) stageError(stage string, err error) error {
+	if err == io.EOF {
+		return err
+	}
+	if c.label != "" {
+		return fmt.Errorf("%s: %s: %w", c.label, stage, err)
+	}
+	return fmt.Errorf("%s: %w", stage, err)
+}
+
+// check return error if c is closed or expired.
+func (c *defaultConn) check() error {
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	if c.opts.MaxAge > 0 && time.Since(c.created) > c.opts.MaxAge {
+		c.Close()
+		return ErrConnExpired
+	}
+	return nil
+}
+
+// maxVarintHead is max length of varint packet size, enough for MaxPacketSize.
+const maxVarintHead = 3
+
+// headLen return length of head of a packet with n bytes payload.
+func (o *ConnOptions) headLen(n int) int {
+	hlen := 2
+	if o.Varint {
+		switch {
+		case n < 1<<7:
+			hlen = 1
+		case n < 1<<14:
+			hlen = 2
+		default:
+			hlen = 3
+		}
+	}
+	if o.LengthCheck {
+		hlen++
+	}
+	return hlen
+}
+
+// putHead put head of a packet with n bytes payload to b, and return head length.
+func (o *ConnOptions) putHead(b []byte, n int) int {
+	var m int
+	if o.Varint {
+		m = binary.PutUvarint(b, uint64(n))
+	} else {
+		b[0], b[1] = byte(n>>8), byte(n&0x000000ff)
+		m = 2
+	}
+	if o.LengthCheck {
+		b[m] = xorBytes(b[:m])
+		m++
+	}
+	return m
+}
+
+// parseHead return payload length in a full packet head, sizes over MaxPacketSize are corrupt.
+func (o *ConnOptions) parseHead(head []byte) (int, error) {
+	n, err := o.decodeHead(head)
+	if err == nil && n > MaxPacketSize {
+		return 0, ErrFramingCorrupt
+	}
+	return n, err
+}
+
+// decodeHead return payload length in a full packet head, not checked against MaxPacketSize.
+func (o *ConnOptions) decodeHead(head []byte) (int, error) {
+	if o.LengthCheck {
+		m := len(head) - 1
+		if head[m] != xorBytes(head[:m]) {
+			return 0, ErrFramingCorrupt
+		}
+		head = head[:m]
+	}
+	if !o.Varint {
+		return int(head[0])<<8 | int(head[1]), nil
+	}
+	n, m := binary.Uvarint(head)
+	if m != len(head) {
+		return 0, ErrFramingCorrupt
+	}
+	return int(n), nil
+}
+
+// headSize return head length of a packet starting with part, 0 if part is not a full head yet.
+func (o *ConnOptions) headSize(part []byte) (int, error) {
+	m := 2
+	if o.Varint {
+		for m = 1; ; m++ {
+			if m > len(part) {
+				return 0, nil
+			}
+			if part[m-1]&0x80 == 0 {
+				break
+			}
+			if m == maxVarintHead {
+				return 0, ErrFramingCorrupt
+			}
+		}
+	}
+	if o.LengthCheck {
+		m++
+	}
+	if len(part) < m {
+		return 0, nil
+	}
+	return m, nil
+}
+
+func xorBytes(b []byte) byte {
+	var x byte
+	for _, v := range b {
+		x ^= v
+	}
+	return x
+}
+
+// midPacketEOF turn io.EOF into io.ErrUnexpectedEOF, for EOF after a packet started, so a truncated packet
+// is not taken as a clean end of stream.
+func midPacketEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readHead read packet head and return payload length and head length.
+func (c *defaultConn) readHead() (int, int, error) {
+	m := 2
+	if c.opts.Varint {
+		// read varint byte by byte, until the last byte without continuation bit.
+		for m = 0; m == 0 || c.rhead[m-1]&0x80 != 0; m++ {
+			if m == maxVarintHead {
+				return 0, 0, ErrFramingCorrupt
+			}
+			_, err := io.ReadFull(c.Conn, c.rhead[m:m+1])
+			if err != nil {
+				if m > 0 {
+					err = midPacketEOF(err)
+				}
+				return 0, 0, err
+			}
+		}
+	} else {
+		_, err := io.ReadFull(c.Conn, c.rhead[:m])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if c.opts.LengthCheck {
+		_, err := io.ReadFull(c.Conn, c.rhead[m:m+1])
+		if err != nil {
+			return 0, 0, midPacketEOF(err)
+		}
+		m++
+	}
+	n, err := c.opts.parseHead(c.rhead[:m])
+	return n, m, err
+}
+
+// ValidateFrame check b is exactly one packet of the default protocol, and return its payload length.
+// It's for transports delivering whole packets out-of-band. See ConnOptions.ValidateFrame for other options.
+func ValidateFrame(b []byte) (int, error) {
+	return ConnOptions{}.ValidateFrame(b)
+}
+
+// ValidateFrame check b is exactly one packet framed under o, and return its payload length.
+// It returns io.ErrUnexpectedEOF for a truncated packet, ErrOverMaxPacketSize for an oversized one,
+// ErrFramingCorrupt for a bad head and ErrTrailingBytes if bytes follow the packet.
+func (o ConnOptions) ValidateFrame(b []byte) (int, error) {
+	hlen, err := o.headSize(b)
+	if err != nil {
+		return 0, err
+	}
+	if hlen == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n, err := o.decodeHead(b[:hlen])
+	if err != nil {
+		return 0, err
+	}
+	if n+hlen > MaxPacketSize {
+		return 0, ErrOverMaxPacketSize
+	}
+	if len(b) < hlen+n {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(b) > hlen+n {
+		return 0, ErrTrailingBytes
+	}
+	return n, nil
+}
+
 // Read read a full udp packet, if b is shorter than packet, return error.
 func (c *defaultConn) Read(b []byte) (int, error) {
-	if len(b) < 2 {
-		return 0, io.ErrShortBuffer
+	if err := c.check(); err != nil {
+		return 0, err
 	}
-	_, err := io.ReadFull(c.Conn, b[:2])
+	n, hlen, err := c.readHead()
 	if err != nil {
+		return 0, c.stageError("reading packet size", err)
+	}
+	if len(b) < n {
+		return 0, c.stageError("reading packet payload", io.ErrShortBuffer)
+	}
+	n, err = io.ReadFull(c.Conn, b[:n])
+	if err != nil {
+		return n, c.stageError("reading packet payload", midPacketEOF(err))
+	}
+	c.onPacket(n, hlen)
+	return n, nil
+}
+
+// ReadDeadline is Read bounded by absolute deadline t, it clears read deadline of the underlying conn after return.
+// If t passes in the middle of a packet, bytes read so far are kept and the next ReadDeadline resumes the packet,
+// so a timeout doesn't desync the stream. So does a short b, retry with a larger one.
+// Don't call Read or ReadFrameChunks while a packet is pending, they don't see the kept bytes.
+// A pending payload is kept in a buffer from allocBuf, freed when the packet completes or by Reset.
+func (c *defaultConn) ReadDeadline(b []byte, t time.Time) (int, error) {
+	if err := c.check(); err != nil {
 		return 0, err
 	}
-	n := int(b[0])<<8 | int(b[1])
+	c.Conn.SetReadDeadline(t)
+	defer c.Conn.SetReadDeadline(time.Time{})
+	var hlen int
+	var err error
+	for {
+		hlen, err = c.opts.headSize(c.rhead[:c.rhlen])
+		if err != nil {
+			return 0, c.stageError("reading packet size", err)
+		}
+		if hlen > 0 {
+			break
+		}
+		k, err := c.Conn.Read(c.rhead[c.rhlen : c.rhlen+1])
+		c.rhlen += k
+		if err != nil {
+			if c.rhlen > 0 {
+				err = midPacketEOF(err)
+			}
+			return 0, c.stageError("reading packet size", err)
+		}
+	}
+	n, err := c.opts.parseHead(c.rhead[:hlen])
+	if err != nil {
+		return 0, c.stageError("reading packet size", err)
+	}
 	if len(b) < n {
-		return 0, io.ErrShortBuffer
+		return 0, c.stageError("reading packet payload", io.ErrShortBuffer)
+	}
+	if c.rpart == nil {
+		c.rpart = allocBuf(MaxPacketSize)[:0]
+	}
+	for len(c.rpart) < n {
+		p := len(c.rpart)
+		k, err := c.Conn.Read(c.rpart[p:n])
+		c.rpart = c.rpart[:p+k]
+		if err != nil {
+			return 0, c.stageError("reading packet payload", midPacketEOF(err))
+		}
+	}
+	copy(b, c.rpart)
+	c.freePart()
+	c.onPacket(n, hlen)
+	return n, nil
+}
+
+// freePart drop the pending packet of ReadDeadline, and free its buffer.
+func (c *defaultConn) freePart() {
+	c.rhlen = 0
+	if c.rpart != nil {
+		freeBuf(c.rpart[:MaxPacketSize])
+		c.rpart = nil
+	}
+}
+
+// ReadFrameChunks read a full udp packet, calling fn with each chunk of payload in order, never buffering the whole.
+// fn must not retain the chunk, it's reused after fn returns.
+// If fn returns error, rest of the packet is discarded to keep the stream in sync, and the error is returned.
+func (c *defaultConn) ReadFrameChunks(fn func([]byte) error) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	n, hlen, err := c.readHead()
+	if err != nil {
+		return c.stageError("reading packet size", err)
+	}
+	chunk := allocBuf(smallBufSize)
+	defer freeBuf(chunk)
+	var fnErr error
+	for remain := n; remain > 0; {
+		m := len(chunk)
+		if remain < m {
+			m = remain
+		}
+		_, err = io.ReadFull(c.Conn, chunk[:m])
+		if err != nil {
+			return c.stageError("reading packet payload", midPacketEOF(err))
+		}
+		remain -= m
+		if fnErr == nil {
+			fnErr = fn(chunk[:m])
+		}
 	}
-	return io.ReadFull(c.Conn, b[:n])
+	c.onPacket(n, hlen)
+	return fnErr
 }
 
 // Write write a full udp packet, if head+b is longer than packet max size, return error.
+// Unless corked, the packet is sent to the underlying conn immediately, Write never buffers.
+// Go enables TCP_NODELAY on tcp conns by default, which is the mechanism pushing each packet without delay.
+// Disable it with (*net.TCPConn).SetNoDelay(false) only if throughput matters more than latency.
 func (c *defaultConn) Write(b []byte) (int, error) {
+	return c.writeContext(context.Background(), b)
+}
+
+func (c *defaultConn) writeContext(ctx context.Context, b []byte) (int, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	if c.broken.Load() {
+		return 0, ErrPartialWrite
+	}
 	n := len(b)
-	if n+2 > MaxPacketSize {
-		return 0, errors.New("over max packet size")
+	if n == 0 {
+		switch c.opts.EmptyWrite {
+		case EmptyWriteError:
+			return 0, ErrEmptyWrite
+		case EmptyWriteDiscard:
+			return 0, nil
+		}
+	}
+	hlen := c.opts.headLen(n)
+	if n+hlen > MaxPacketSize {
+		return 0, ErrOverMaxPacketSize
+	}
+	// write head and payload in a single Write, a short head write never desyncs the stream.
+	buf := allocBuf(hlen + n)
+	defer freeBuf(buf)
+	c.opts.putHead(buf, n)
+	copy(buf[hlen:], b)
+	c.wmutex.Lock()
+	if c.corked {
+		// keep buffered packets within MaxPacketSize, the largest single write of c.
+		if len(c.wbuf)+len(buf) > MaxPacketSize {
+			if err := c.flush(ctx); err != nil {
+				c.wmutex.Unlock()
+				return 0, err
+			}
+		}
+		c.wbuf = append(c.wbuf, buf...)
+		c.wmutex.Unlock()
+		c.onPacket(n, hlen)
+		return n, nil
+	}
+	c.wmutex.Unlock()
+	m, err := c.write(ctx, buf)
+	if err == nil {
+		c.onPacket(n, hlen)
+	}
+	if m < hlen {
+		return 0, err
+	}
+	return m - hlen, err
+}
+
+// SetLabel tag c with label, e.g. a tenant id. The label prefixes errors returned by c.
+// It's not safe for concurrent use with other methods, set it before using c.
+func (c *defaultConn) SetLabel(label string) {
+	c.label = label
+}
+
+// Label return label of c, see SetLabel.
+func (c *defaultConn) Label() string {
+	return c.label
+}
+
+// IsClient report whether c is client side, i.e. created by DefaultOutConn or NewOutConn.
+func (c *defaultConn) IsClient() bool {
+	return c.isClient
+}
+
+// ID return ConnOptions.ID of c.
+func (c *defaultConn) ID() string {
+	return c.opts.ID
+}
+
+// connID return id of conn, or empty if conn has no id.
+func connID(conn net.Conn) string {
+	if c, ok := conn.(interface{ ID() string }); ok {
+		return c.ID()
+	}
+	return ""
+}
+
+// Options return options of c. Nothing is negotiated in handshake, so they are the options c was created with.
+func (c *defaultConn) Options() ConnOptions {
+	return c.opts
+}
+
+// EffectiveMaxPacketSize return max payload size Write accepts under current options.
+// Packet size is not negotiated in handshake, so it's the same before and after handshake.
+func (c *defaultConn) EffectiveMaxPacketSize() int {
+	return MaxPacketSize - c.opts.headLen(MaxPacketSize)
+}
+
+// FrameSize return on-wire size of a packet with payloadLen bytes payload, under current options.
+func (c *defaultConn) FrameSize(payloadLen int) int {
+	return c.opts.headLen(payloadLen) + payloadLen
+}
+
+// onPacket account a packet read or written with n bytes payload and hlen bytes head.
+func (c *defaultConn) onPacket(n int, hlen int) {
+	c.payloadBytes.Add(uint64(n))
+	c.overheadBytes.Add(uint64(hlen))
+	if c.opts.OnFrame != nil {
+		c.opts.OnFrame(n)
+	}
+}
+
+// OverheadRatio return the fraction of framing overhead in all bytes read and written, 0 if nothing transferred.
+// A high ratio means packets are small, consider Cork to batch them.
+func (c *defaultConn) OverheadRatio() float64 {
+	overhead := float64(c.overheadBytes.Load())
+	payload := float64(c.payloadBytes.Load())
+	if overhead+payload == 0 {
+		return 0
+	}
+	return overhead / (overhead + payload)
+}
+
+// write write buf of whole packets to the underlying conn, break c if packets were partially written.
+// It's bounded by the earlier of ctx deadline and WriteTimeout.
+func (c *defaultConn) write(ctx context.Context, buf []byte) (int, error) {
+	deadline, ok := ctx.Deadline()
+	if c.opts.WriteTimeout > 0 {
+		if t := time.Now().Add(c.opts.WriteTimeout); !ok || t.Before(deadline) {
+			deadline, ok = t, true
+		}
+	}
+	if ok {
+		c.Conn.SetWriteDeadline(deadline)
+		defer c.Conn.SetWriteDeadline(time.Time{})
+		// the deadline overrides the one a cancellation of WriteContext set, check it again.
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	m, err := c.Conn.Write(buf)
+	if m > 0 && m < len(buf) {
+		c.broken.Store(true)
 	}
-	_, err := c.Conn.Write([]byte{byte(n >> 8), byte(n & 0x000000ff)})
 	if err != nil {
+		return m, c.stageError("writing packet", err)
+	}
+	return m, nil
+}
+
+// Cork buffer packets written after it, until Uncork.
+// It lets caller batch several packets into a single underlying write, like TCP_CORK.
+// Buffered packets are flushed early when they would exceed MaxPacketSize bytes.
+func (c *defaultConn) Cork() {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	c.corked = true
+}
+
+// Uncork write packets buffered since Cork in a single underlying write, and stop buffering.
+func (c *defaultConn) Uncork() error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	c.corked = false
+	return c.flush(context.Background())
+}
+
+// Flush write packets buffered since Cork in a single underlying write, and keep corked.
+func (c *defaultConn) Flush() error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	return c.flush(context.Background())
+}
+
+func (c *defaultConn) flush(ctx context.Context) error {
+	if len(c.wbuf) == 0 {
+		return nil
+	}
+	if c.broken.Load() {
+		return ErrPartialWrite
+	}
+	_, err := c.write(ctx, c.wbuf)
+	c.wbuf = c.wbuf[:0]
+	return err
+}
+
+// closeFlushTimeout bounds flushing buffered packets in Close, so Close never blocks on a peer not reading.
+const closeFlushTimeout = time.Second * 5
+
+// Close flush buffered packets and close the underlying conn. Subsequent Read and Write return net.ErrClosed.
+// The flush is bounded by the earlier of 5s and WriteTimeout, the packets are dropped if it times out.
+func (c *defaultConn) Close() error {
+	if c.closed.Swap(true) {
+		return c.Conn.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+	defer cancel()
+	c.wmutex.Lock()
+	err := c.flush(ctx)
+	c.wmutex.Unlock()
+	if err1 := c.Conn.Close(); err1 != nil {
+		return err1
+	}
+	return err
+}
+
+// WithValue attach a key-value to c and return c, e.g. a correlation id for middleware.
+// It's safe for concurrent use. A later value shadows the former one with the same key.
+func (c *defaultConn) WithValue(key, val interface{}) Conn {
+	node := &valueNode{key: key, val: val}
+	for {
+		node.next = c.values.Load()
+		if c.values.CompareAndSwap(node.next, node) {
+			return c
+		}
+	}
+}
+
+// Value return the value attached to c for key, or nil if no value.
+func (c *defaultConn) Value(key interface{}) interface{} {
+	for node := c.values.Load(); node != nil; node = node.next {
+		if node.key == key {
+			return node.val
+		}
+	}
+	return nil
+}
+
+// netConn return the underlying conn, unwrapping conns like prereadConn that wrap another.
+func (c *defaultConn) netConn() net.Conn {
+	conn := c.Conn
+	for {
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = w.NetConn()
+	}
+}
+
+// SyscallConn return raw conn of the underlying conn, to set socket options not otherwise exposed.
+// It returns error if the underlying conn does not implement syscall.Conn.
+func (c *defaultConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.netConn().(syscall.Conn)
+	if !ok {
+		return nil, errNoSyscallConn
+	}
+	return sc.SyscallConn()
+}
+
+// WriteContext is Write bounded by ctx deadline and cancellation.
+// It clears write deadline of the underlying conn after return.
+// If ctx is done in the middle of a packet, the conn is broken, see ErrPartialWrite.
+func (c *defaultConn) WriteContext(ctx context.Context, b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
 		return 0, err
 	}
-	return c.Conn.Write(b)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.Conn.SetWriteDeadline(time.Now()) // wake up Write
+		case <-stop:
+		}
+	}()
+	n, err := c.writeContext(ctx, b)
+	close(stop)
+	<-stopped
+	c.Conn.SetWriteDeadline(time.Time{})
+	if err != nil && ctx.Err() != nil {
+		if c.broken.Load() {
+			return n, ErrPartialWrite
+		}
+		return n, ctx.Err()
+	}
+	return n, err
+}
+
+// SetLinger forward to SetLinger of the underlying *net.TCPConn, to control TIME_WAIT behavior of high-churn relays.
+// It returns error if the underlying conn is not a tcp conn.
+func (c *defaultConn) SetLinger(sec int) error {
+	tc, ok := c.netConn().(interface{ SetLinger(int) error })
+	if !ok {
+		return errors.New("underlying conn does not support SetLinger")
+	}
+	return tc.SetLinger(sec)
+}
+
+// Reset rebind c to a new underlying conn, and clear closed, broken, corked, buffered, pending read, attached values, label and counters.
+// Options are kept. It enables reusing conns with sync.Pool, c must not be in use by other goroutines.
+func (c *defaultConn) Reset(conn net.Conn, isClient bool) {
+	c.Conn = conn
+	c.isClient = isClient
+	c.created = time.Now()
+	c.closed.Store(false)
+	c.broken.Store(false)
+	c.corked = false
+	c.wbuf = c.wbuf[:0]
+	c.values.Store(nil)
+	c.label = ""
+	c.freePart()
+	c.payloadBytes.Store(0)
+	c.overheadBytes.Store(0)
 }
@@ -0,0 +1,918 @@
+package uot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadDeadlineResume(t *testing.T) {
+	for _, opts := range []ConnOptions{{}, {Varint: true}, {LengthCheck: true}, {Varint: true, LengthCheck: true}} {
+		a, b := net.Pipe()
+		c := newConn(a, opts, false)
+
+		payload := bytes.Repeat([]byte{'x'}, 200)
+		frame := make([]byte, maxVarintHead+1+len(payload))
+		hlen := opts.putHead(frame, len(payload))
+		frame = append(frame[:hlen], payload...)
+		half := hlen + len(payload)/2
+		second := make(chan struct{})
+		go func() {
+			b.Write(frame[:half])
+			<-second
+			b.Write(frame[half:])
+		}()
+
+		buf := make([]byte, MaxPacketSize)
+		_, err := c.ReadDeadline(buf, time.Now().Add(50*time.Millisecond))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("%+v: first ReadDeadline error = %v, want deadline exceeded", opts, err)
+		}
+		close(second)
+		n, err := c.ReadDeadline(buf, time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("%+v: resumed ReadDeadline error = %v", opts, err)
+		}
+		if !bytes.Equal(buf[:n], payload) {
+			t.Fatalf("%+v: resumed ReadDeadline got %d bytes, want the whole payload", opts, n)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestReadDeadlineOversizedHead(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := newConn(a, ConnOptions{}, false)
+	go b.Write([]byte{0xff, 0xff})
+
+	_, err := c.ReadDeadline(make([]byte, 1<<16), time.Now().Add(time.Second))
+	if !errors.Is(err, ErrFramingCorrupt) {
+		t.Fatalf("ReadDeadline error = %v, want ErrFramingCorrupt", err)
+	}
+}
+
+func TestWritePacketDeadline(t *testing.T) {
+	rc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	lc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lc.Close()
+	c := DefaultPacketConn(lc).(*defaultPacketConn)
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+
+	_, err = c.WritePacketDeadline([]byte("late"), target, rc.LocalAddr(), time.Nanosecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("WritePacketDeadline error = %v, want deadline exceeded", err)
+	}
+	// the deadline is cleared, a plain write is not bounded by it.
+	if _, err = c.WritePacket([]byte("ok"), target, rc.LocalAddr()); err != nil {
+		t.Fatalf("WritePacket after deadline error = %v", err)
+	}
+	buf := make([]byte, 64)
+	rc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := rc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte("ok")) {
+		t.Fatalf("got packet %x, want the plain write", buf[:n])
+	}
+}
+
+func TestReadErrorStage(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  ConnOptions
+		data  []byte
+		stage string
+		want  error
+	}{
+		{"clean end", ConnOptions{}, nil, "", io.EOF},
+		{"truncated size", ConnOptions{}, []byte{0}, "reading packet size", io.ErrUnexpectedEOF},
+		{"truncated varint size", ConnOptions{Varint: true}, []byte{0x80}, "reading packet size", io.ErrUnexpectedEOF},
+		{"missing length check", ConnOptions{LengthCheck: true}, []byte{0, 3}, "reading packet size", io.ErrUnexpectedEOF},
+		{"corrupt length check", ConnOptions{LengthCheck: true}, []byte{0, 3, 0}, "reading packet size", ErrFramingCorrupt},
+		{"missing payload", ConnOptions{}, []byte{0, 3}, "reading packet payload", io.ErrUnexpectedEOF},
+		{"truncated payload", ConnOptions{}, []byte{0, 3, 'a'}, "reading packet payload", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		c := newConn(a, tt.opts, false)
+		go func(data []byte) {
+			b.Write(data)
+			b.Close()
+		}(tt.data)
+
+		_, err := c.Read(make([]byte, MaxPacketSize))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Read error = %v, want %v", tt.name, err, tt.want)
+		}
+		if tt.stage == "" && err != io.EOF {
+			t.Errorf("%s: Read error = %#v, want bare io.EOF", tt.name, err)
+		}
+		if tt.stage != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.stage+": ")) {
+			t.Errorf("%s: Read error = %v, want stage %q", tt.name, err, tt.stage)
+		}
+		a.Close()
+	}
+}
+
+func TestReadErrorLabel(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	c := newConn(a, ConnOptions{}, false)
+	c.SetLabel("tenant-1")
+	go func() {
+		b.Write([]byte{0})
+		b.Close()
+	}()
+
+	_, err := c.Read(make([]byte, MaxPacketSize))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Read error = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if want := "tenant-1: reading packet size: "; !strings.HasPrefix(err.Error(), want) {
+		t.Fatalf("Read error = %q, want prefix %q", err, want)
+	}
+}
+
+// framingOptions is every combination of options changing the wire format of packets.
+var framingOptions = []ConnOptions{{}, {Varint: true}, {LengthCheck: true}, {Varint: true, LengthCheck: true}}
+
+func TestFramingRoundTrip(t *testing.T) {
+	for _, opts := range framingOptions {
+		a, b := net.Pipe()
+		w, r := newConn(a, opts, true), newConn(b, opts, false)
+		// 1-byte and multi-byte varint sizes, and their boundaries.
+		sizes := []int{0, 1, 127, 128, 300, 16383, 16384, w.EffectiveMaxPacketSize()}
+		go func() {
+			for _, size := range sizes {
+				if _, err := w.Write(bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+					t.Errorf("%+v: Write %d bytes error = %v", opts, size, err)
+				}
+			}
+		}()
+
+		buf := make([]byte, MaxPacketSize)
+		for _, size := range sizes {
+			n, err := r.Read(buf)
+			if err != nil {
+				t.Fatalf("%+v: Read %d bytes error = %v", opts, size, err)
+			}
+			if !bytes.Equal(buf[:n], bytes.Repeat([]byte{byte(size)}, size)) {
+				t.Fatalf("%+v: Read got %d bytes, want %d", opts, n, size)
+			}
+		}
+		if _, err := w.Write(make([]byte, w.EffectiveMaxPacketSize()+1)); err == nil {
+			t.Fatalf("%+v: Write over EffectiveMaxPacketSize succeeded", opts)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func FuzzParseHead(f *testing.F) {
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x7f, 0x7f})
+	f.Add([]byte{0x80, 0x01, 0x81})
+	f.Add([]byte{0xff, 0xff, 0xff, 0x00})
+	f.Add([]byte{0xe3, 0xff, 0x03, 0x1f})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, opts := range framingOptions {
+			c := newConn(&prereadConn{r: bytes.NewReader(data)}, opts, false)
+			n, hlen, err := c.readHead()
+			if err != nil {
+				continue
+			}
+			if n < 0 || n > MaxPacketSize {
+				t.Fatalf("%+v: head %x parsed as size %d", opts, data[:hlen], n)
+			}
+			if got, _ := opts.headSize(data[:hlen]); got != hlen {
+				t.Fatalf("%+v: headSize of %x = %d, readHead read %d", opts, data[:hlen], got, hlen)
+			}
+			// a head from putHead parses to the same size.
+			head := make([]byte, maxVarintHead+1)
+			m := opts.putHead(head, n)
+			if got, err := opts.parseHead(head[:m]); err != nil || got != n {
+				t.Fatalf("%+v: putHead(%d) parsed as %d, %v", opts, n, got, err)
+			}
+		}
+	})
+}
+
+// tcpPair return both ends of a loopback tcp connection.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestInConnPrereadHandoff(t *testing.T) {
+	opts := ConnOptions{Varint: true, LengthCheck: true, HandshakeEcho: true}
+	cc, sc := tcpPair(t)
+	target := targetAddr(ParseSocksAddr("example.com:53"))
+	client := NewOutConn(cc, opts)
+	done := make(chan error, 1)
+	go func() {
+		if _, err := client.Handshake(target); err != nil {
+			done <- err
+			return
+		}
+		_, err := client.Write([]byte("hello"))
+		done <- err
+	}()
+
+	// a front-end peeks the first bytes of the handshake before handing off.
+	peeked := make([]byte, 3)
+	if _, err := io.ReadFull(sc, peeked); err != nil {
+		t.Fatal(err)
+	}
+	server := NewInConnPreread(sc, peeked, opts)
+	addr, err := server.Handshake(nil)
+	if err != nil || addr.String() != target.String() {
+		t.Fatalf("Handshake = %v, %v, want %s", addr, err, target)
+	}
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("client error = %v", err)
+	}
+
+	// socket level methods reach the tcp conn under the preread wrapper.
+	dc := server.(*defaultConn)
+	if _, err = dc.SyscallConn(); err != nil {
+		t.Errorf("SyscallConn error = %v", err)
+	}
+	if err = dc.SetLinger(0); err != nil {
+		t.Errorf("SetLinger error = %v", err)
+	}
+	if _, err = dc.TransportStats(); err != nil && err != ErrUnsupported {
+		t.Errorf("TransportStats error = %v", err)
+	}
+}
+
+func TestWriteContextCancelMidPacket(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := newConn(a, ConnOptions{WriteTimeout: time.Hour}, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// the peer reads part of the packet, then stops reading.
+		io.ReadFull(b, make([]byte, 10))
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := c.WriteContext(ctx, make([]byte, 1000))
+	if err != ErrPartialWrite {
+		t.Fatalf("WriteContext error = %v, want ErrPartialWrite", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("cancellation waited for WriteTimeout")
+	}
+	if _, err = c.Write([]byte("next")); err != ErrPartialWrite {
+		t.Fatalf("Write after a partial packet error = %v, want ErrPartialWrite", err)
+	}
+}
+
+func TestWriteContextCancelBeforeWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := newConn(a, ConnOptions{WriteTimeout: time.Hour}, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// nobody reads b, the packet is never started.
+	_, err := c.WriteContext(ctx, []byte("hello"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WriteContext error = %v, want context.DeadlineExceeded", err)
+	}
+	go io.ReadFull(b, make([]byte, 2+len("again")))
+	if _, err = c.Write([]byte("again")); err != nil {
+		t.Fatalf("Write after a cancelled WriteContext error = %v", err)
+	}
+}
+
+func TestReadDeadlineBuffer(t *testing.T) {
+	var allocs, frees int
+	SetBufferAllocator(func(n int) []byte {
+		allocs++
+		return make([]byte, n)
+	}, func([]byte) {
+		frees++
+	})
+	defer SetBufferAllocator(nil, nil)
+
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newConn(a, ConnOptions{}, false)
+	go b.Write([]byte{0, 4, 'h', 'a'})
+	buf := make([]byte, 16)
+	if _, err := c.ReadDeadline(buf, time.Now().Add(50*time.Millisecond)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("ReadDeadline error = %v, want deadline exceeded", err)
+	}
+	if allocs != 1 || frees != 0 {
+		t.Fatalf("pending packet: %d allocs, %d frees, want 1, 0", allocs, frees)
+	}
+	go b.Write([]byte{'l', 'f'})
+	if n, err := c.ReadDeadline(buf, time.Now().Add(time.Second)); err != nil || string(buf[:n]) != "half" {
+		t.Fatalf("ReadDeadline = %q, %v", buf[:n], err)
+	}
+	if frees != 1 {
+		t.Fatalf("completed packet: %d frees, want 1", frees)
+	}
+
+	// Reset frees a pending packet.
+	go b.Write([]byte{0, 4, 'h'})
+	c.ReadDeadline(buf, time.Now().Add(50*time.Millisecond))
+	c.Reset(a, false)
+	if allocs != 2 || frees != 2 {
+		t.Fatalf("reset: %d allocs, %d frees, want 2, 2", allocs, frees)
+	}
+}
+
+func TestValidateFrame(t *testing.T) {
+	for _, opts := range framingOptions {
+		frame := func(n int, payload int) []byte {
+			b := make([]byte, maxVarintHead+1+payload)
+			m := opts.putHead(b, n)
+			return b[:m+payload]
+		}
+		good := frame(300, 300)
+		if n, err := opts.ValidateFrame(good); err != nil || n != 300 {
+			t.Errorf("%+v: valid frame = %d, %v", opts, n, err)
+		}
+		tests := []struct {
+			name string
+			b    []byte
+			want error
+		}{
+			{"empty", nil, io.ErrUnexpectedEOF},
+			{"truncated head", good[:1], io.ErrUnexpectedEOF},
+			{"truncated payload", good[:len(good)-1], io.ErrUnexpectedEOF},
+			{"oversized", frame(MaxPacketSize, 0), ErrOverMaxPacketSize},
+			{"trailing bytes", append(good, 0), ErrTrailingBytes},
+		}
+		for _, tt := range tests {
+			if _, err := opts.ValidateFrame(tt.b); err != tt.want {
+				t.Errorf("%+v: %s frame error = %v, want %v", opts, tt.name, err, tt.want)
+			}
+		}
+	}
+	if _, err := (ConnOptions{LengthCheck: true}).ValidateFrame([]byte{0, 1, 0, 'x'}); err != ErrFramingCorrupt {
+		t.Errorf("bad length check error = %v, want ErrFramingCorrupt", err)
+	}
+	if n, err := ValidateFrame([]byte{0, 2, 'h', 'i'}); err != nil || n != 2 {
+		t.Errorf("ValidateFrame of default frame = %d, %v", n, err)
+	}
+}
+
+// writeCountConn count writes to the underlying conn.
+type writeCountConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *writeCountConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func TestCorkSingleWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	wc := &writeCountConn{Conn: a}
+	c := newConn(wc, ConnOptions{}, true)
+	go io.Copy(io.Discard, b)
+
+	c.Cork()
+	for _, p := range []string{"one", "two", "three"} {
+		if _, err := c.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wc.writes != 0 {
+		t.Fatalf("%d underlying writes while corked, want 0", wc.writes)
+	}
+	if err := c.Uncork(); err != nil {
+		t.Fatal(err)
+	}
+	if wc.writes != 1 {
+		t.Fatalf("%d underlying writes on Uncork, want 1", wc.writes)
+	}
+
+	// buffered packets never exceed MaxPacketSize.
+	c.Cork()
+	big := make([]byte, MaxPacketSize/2)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Write(big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.wbuf) > MaxPacketSize || wc.writes != 3 {
+		t.Fatalf("corked %d bytes after %d writes, want at most MaxPacketSize after 3", len(c.wbuf), wc.writes)
+	}
+	c.Close()
+}
+
+func TestCloseFlushBounded(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newConn(a, ConnOptions{WriteTimeout: 50 * time.Millisecond}, true)
+	c.Cork()
+	c.Write([]byte("never read"))
+
+	done := make(chan error, 1)
+	go func() { done <- c.Close() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Close error = %v, want deadline exceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked on a peer not reading")
+	}
+}
+
+type ctxKey string
+
+// valueWrapper is a middleware Conn, forwarding values to the wrapped Conn.
+type valueWrapper struct {
+	Conn
+}
+
+func (w valueWrapper) WithValue(key, val interface{}) Conn {
+	w.Conn.(Valuer).WithValue(key, val)
+	return w
+}
+
+func (w valueWrapper) Value(key interface{}) interface{} {
+	return w.Conn.(Valuer).Value(key)
+}
+
+func TestValueThroughWrappers(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	var conn Conn = newConn(a, ConnOptions{}, true)
+	conn = valueWrapper{conn}
+	conn.(Valuer).WithValue(ctxKey("request"), "r-1")
+	conn = valueWrapper{conn}
+	conn = conn.(Valuer).WithValue(ctxKey("tenant"), "t-1")
+	conn.(Valuer).WithValue(ctxKey("request"), "r-2") // shadows r-1
+
+	v := conn.(Valuer)
+	if got := v.Value(ctxKey("tenant")); got != "t-1" {
+		t.Fatalf("tenant value = %v, want t-1", got)
+	}
+	if got := v.Value(ctxKey("request")); got != "r-2" {
+		t.Fatalf("request value = %v, want r-2", got)
+	}
+	if got := v.Value(ctxKey("missing")); got != nil {
+		t.Fatalf("missing value = %v, want nil", got)
+	}
+}
+
+func TestResetFreshHandshake(t *testing.T) {
+	target := targetAddr(ParseSocksAddr("example.com:53"))
+	handshake := func(c *defaultConn, peer net.Conn) {
+		t.Helper()
+		server := DefaultInConn(peer)
+		done := make(chan error, 1)
+		go func() {
+			addr, err := server.Handshake(nil)
+			if err == nil && addr.String() != target.String() {
+				err = errors.New("server got target " + addr.String())
+			}
+			if err == nil {
+				_, err = server.Read(make([]byte, 16))
+			}
+			done <- err
+		}()
+		if _, err := c.Handshake(target); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, b := net.Pipe()
+	c := newConn(a, ConnOptions{}, true)
+	handshake(c, b)
+	c.SetLabel("old")
+	c.WithValue(ctxKey("k"), "v")
+	c.Cork()
+	c.Close()
+	b.Close()
+
+	a, b = net.Pipe()
+	defer b.Close()
+	c.Reset(a, true)
+	if c.Label() != "" || c.Value(ctxKey("k")) != nil || c.OverheadRatio() != 0 || c.corked {
+		t.Fatal("Reset kept state of the former conn")
+	}
+	handshake(c, b)
+	c.Close()
+}
+
+func TestHandshakeEcho(t *testing.T) {
+	opts := ConnOptions{HandshakeEcho: true}
+	a, b := net.Pipe()
+	defer b.Close()
+	go NewInConn(b, opts).Handshake(nil)
+	if _, err := NewOutConn(a, opts).Handshake(targetAddr(ParseSocksAddr("Example.com.:53"))); err != nil {
+		t.Fatalf("Handshake error = %v", err)
+	}
+
+	// a server echoing a different address.
+	a, b = net.Pipe()
+	defer b.Close()
+	go func() {
+		if _, err := ReadSocksAddr(b); err == nil {
+			b.Write(ParseSocksAddr("example.org:53"))
+		}
+	}()
+	if _, err := NewOutConn(a, opts).Handshake(targetAddr(ParseSocksAddr("example.com:53"))); err != ErrHandshakeMismatch {
+		t.Fatalf("Handshake error = %v, want ErrHandshakeMismatch", err)
+	}
+}
+
+func TestClosedWrappers(t *testing.T) {
+	ops := func(conn Conn) map[string]error {
+		_, rerr := conn.Read(make([]byte, 16))
+		_, werr := conn.Write([]byte("hi"))
+		_, herr := conn.Handshake(targetAddr(ParseSocksAddr("example.com:53")))
+		return map[string]error{"Read": rerr, "Write": werr, "Handshake": herr}
+	}
+
+	// close the outermost layer.
+	a, b := net.Pipe()
+	defer b.Close()
+	capture := WithCapture(a, io.Discard)
+	var conn Conn = valueWrapper{newConn(capture, ConnOptions{}, true)}
+	conn.Close()
+	for op, err := range ops(conn) {
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("%s after Close error = %v, want net.ErrClosed", op, err)
+		}
+	}
+	if _, err := capture.Write([]byte("hi")); err != net.ErrClosed {
+		t.Errorf("capture Write after Close error = %v, want net.ErrClosed", err)
+	}
+
+	// close an inner layer only.
+	a, b = net.Pipe()
+	defer b.Close()
+	capture = WithCapture(a, io.Discard)
+	conn = valueWrapper{newConn(capture, ConnOptions{}, true)}
+	capture.Close()
+	for op, err := range ops(conn) {
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("%s after inner Close error = %v, want net.ErrClosed", op, err)
+		}
+	}
+}
+
+// byteConn writes to the underlying conn one byte at a time.
+// With short, it stops after the first byte and reports io.ErrShortWrite.
+type byteConn struct {
+	net.Conn
+	short bool
+}
+
+func (c byteConn) Write(b []byte) (int, error) {
+	for i := range b {
+		if c.short && i > 0 {
+			return i, io.ErrShortWrite
+		}
+		if _, err := c.Conn.Write(b[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(b), nil
+}
+
+func TestWriteOneByteAtATime(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newConn(byteConn{Conn: a}, ConnOptions{}, true)
+	peer := newConn(b, ConnOptions{}, false)
+	packets := []string{"a", "hello", string(make([]byte, 300))}
+	go func() {
+		for _, p := range packets {
+			c.Write([]byte(p))
+		}
+	}()
+	buf := make([]byte, 512)
+	for _, p := range packets {
+		n, err := peer.Read(buf)
+		if err != nil || string(buf[:n]) != p {
+			t.Fatalf("read %q, %v, want %q", buf[:n], err, p)
+		}
+	}
+
+	// a writer giving up after the head's first byte leaves the stream desynced, c must refuse later writes.
+	a, b = net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	c = newConn(byteConn{Conn: a, short: true}, ConnOptions{}, true)
+	if _, err := c.Write([]byte("hello")); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("short Write error = %v, want io.ErrShortWrite", err)
+	}
+	if _, err := c.Write([]byte("hello")); err != ErrPartialWrite {
+		t.Fatalf("Write after short write error = %v, want ErrPartialWrite", err)
+	}
+}
+
+func TestReadOneBytePayload(t *testing.T) {
+	for _, opts := range framingOptions {
+		a, b := net.Pipe()
+		c, peer := newConn(a, opts, true), newConn(b, opts, false)
+		go func() {
+			c.Write([]byte{'x'})
+			c.Write([]byte{'y'})
+		}()
+		read := map[string]func([]byte) (int, error){
+			"Read":         peer.Read,
+			"ReadDeadline": func(p []byte) (int, error) { return peer.ReadDeadline(p, time.Now().Add(time.Second)) },
+		}
+		for i, name := range []string{"Read", "ReadDeadline"} {
+			buf := bytes.Repeat([]byte{0xee}, 4)
+			n, err := read[name](buf)
+			if err != nil || n != 1 || buf[0] != "xy"[i] {
+				t.Fatalf("%+v %s = %d %q, %v", opts, name, n, buf[:1], err)
+			}
+			if !bytes.Equal(buf[1:], []byte{0xee, 0xee, 0xee}) {
+				t.Fatalf("%+v %s leaked head bytes into payload buffer: %x", opts, name, buf)
+			}
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestSyscallConn(t *testing.T) {
+	a, _ := tcpPair(t)
+	rc, err := newConn(a, ConnOptions{}, true).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn error = %v", err)
+	}
+	var fd uintptr
+	if err = rc.Control(func(f uintptr) { fd = f }); err != nil {
+		t.Fatalf("Control error = %v", err)
+	}
+	if fd == 0 {
+		t.Fatal("Control saw no socket")
+	}
+
+	p, q := net.Pipe()
+	defer p.Close()
+	defer q.Close()
+	if _, err = newConn(p, ConnOptions{}, true).SyscallConn(); err != errNoSyscallConn {
+		t.Fatalf("SyscallConn of a pipe conn error = %v, want errNoSyscallConn", err)
+	}
+}
+
+func TestEmptyWrite(t *testing.T) {
+	tests := []struct {
+		mode  EmptyWriteMode
+		err   error
+		reads []string // packets peer reads after the empty write and a "x" write
+	}{
+		{EmptyWriteFrame, nil, []string{"", "x"}},
+		{EmptyWriteError, ErrEmptyWrite, []string{"x"}},
+		{EmptyWriteDiscard, nil, []string{"x"}},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		c, peer := newConn(a, ConnOptions{EmptyWrite: tt.mode}, true), newConn(b, ConnOptions{}, false)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := c.Write(nil)
+			c.Write([]byte("x"))
+			errc <- err
+		}()
+		buf := make([]byte, 16)
+		for _, want := range tt.reads {
+			n, err := peer.Read(buf)
+			if err != nil || string(buf[:n]) != want {
+				t.Fatalf("mode %d read %q, %v, want %q", tt.mode, buf[:n], err, want)
+			}
+		}
+		if err := <-errc; err != tt.err {
+			t.Fatalf("mode %d empty Write error = %v, want %v", tt.mode, err, tt.err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestOnFrame(t *testing.T) {
+	var mu sync.Mutex
+	sizes := map[string][]int{}
+	collect := func(side string) func(int) {
+		return func(n int) {
+			mu.Lock()
+			sizes[side] = append(sizes[side], n)
+			mu.Unlock()
+		}
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := newConn(a, ConnOptions{OnFrame: collect("write")}, true)
+	peer := newConn(b, ConnOptions{OnFrame: collect("read")}, false)
+	want := []int{1, 0, 300, 2}
+	done := make(chan struct{})
+	go func() {
+		for _, n := range want {
+			c.Write(make([]byte, n))
+		}
+		close(done)
+	}()
+	buf := make([]byte, 512)
+	for range want {
+		if _, err := peer.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	for _, side := range []string{"write", "read"} {
+		if fmt.Sprint(sizes[side]) != fmt.Sprint(want) {
+			t.Errorf("%s sizes = %v, want %v", side, sizes[side], want)
+		}
+	}
+}
+
+func TestReadFrameChunks(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c, peer := newConn(a, ConnOptions{}, true), newConn(b, ConnOptions{}, false)
+	sizes := []int{0, smallBufSize - 1, smallBufSize, smallBufSize + 1, 2*smallBufSize + 5}
+	go func() {
+		for i, n := range sizes {
+			c.Write(bytes.Repeat([]byte{byte('a' + i)}, n))
+		}
+	}()
+	for i, n := range sizes {
+		var got []byte
+		var chunks []int
+		err := peer.ReadFrameChunks(func(chunk []byte) error {
+			got = append(got, chunk...)
+			chunks = append(chunks, len(chunk))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, bytes.Repeat([]byte{byte('a' + i)}, n)) {
+			t.Fatalf("packet %d of %d bytes read as %d bytes", i, n, len(got))
+		}
+		for j, m := range chunks {
+			if m > smallBufSize || (j < len(chunks)-1 && m != smallBufSize) {
+				t.Fatalf("packet of %d bytes read in chunks %v", n, chunks)
+			}
+		}
+	}
+}
+
+func TestReadFrameChunksError(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c, peer := newConn(a, ConnOptions{}, true), newConn(b, ConnOptions{}, false)
+	go func() {
+		c.Write(make([]byte, 3*smallBufSize))
+		c.Write([]byte("next"))
+	}()
+	errStop := errors.New("stop")
+	calls := 0
+	err := peer.ReadFrameChunks(func([]byte) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Fatalf("ReadFrameChunks = %v after %d calls, want errStop after 1", err, calls)
+	}
+	// rest of the failed packet is discarded, the stream is still in sync.
+	buf := make([]byte, 16)
+	n, err := peer.Read(buf)
+	if err != nil || string(buf[:n]) != "next" {
+		t.Fatalf("read after fn error %q, %v, want next", buf[:n], err)
+	}
+}
+
+func TestWritePacketConcurrent(t *testing.T) {
+	const writers, packets, receivers = 8, 16, 4
+	lc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lc.Close()
+	c := DefaultPacketConn(lc)
+	var rcs []PacketConn
+	for i := 0; i < receivers; i++ {
+		rc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		rcs = append(rcs, DefaultPacketConn(rc))
+	}
+	targets := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		targetAddr(ParseSocksAddr("example.com:123")),
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < packets; i++ {
+				k := (g + i) % receivers
+				target := targets[(g*packets+i)%len(targets)]
+				p := fmt.Sprintf("%d %s", k, target)
+				if _, err := c.WritePacket([]byte(p), target, rcs[k].LocalAddr()); err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	// every packet arrives at its receiver with its own target, as long as the buffers are not shared.
+	errc := make(chan error, receivers)
+	for k, rc := range rcs {
+		go func(k int, rc PacketConn) {
+			buf := make([]byte, 512)
+			for i := 0; i < writers*packets/receivers; i++ {
+				rc.SetReadDeadline(time.Now().Add(time.Second))
+				n, target, _, err := rc.ReadPacket(buf)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if want := fmt.Sprintf("%d %s", k, target); string(buf[:n]) != want {
+					errc <- fmt.Errorf("receiver %d got %q, want %q", k, buf[:n], want)
+					return
+				}
+			}
+			errc <- nil
+		}(k, rc)
+	}
+	wg.Wait()
+	for range rcs {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+}